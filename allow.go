@@ -0,0 +1,120 @@
+package limiter
+
+import "context"
+
+// Allow counts a request of cost against the global limit of the client identified by key, for the
+// limiting outside of gin (workers, other transports). The limit is shared with the middlewares for
+// the same key. On an error of redis allowed follows WithFailOpen, in the dry run mode it is always true.
+func (dispatch *Dispatcher) Allow(ctx context.Context, key string, cost int) (allowed bool, state LimitState, err error) {
+	if cost < 0 {
+		cost = 0
+	}
+	state, exceeded, err := dispatch.check(ctx, key, RouteLimit{}, "", cost, nil, false)
+	if err != nil {
+		return dispatch.failOpen, state, err
+	}
+	dispatch.countRequest(state, RouteLimit{}, exceeded)
+	if exceeded != nil && dispatch.dryRun {
+		dispatch.logger.Printf("limiter: dry run, %s exceeded the %s limit", key, exceeded.Scope)
+	}
+	return exceeded == nil || dispatch.dryRun, state, nil
+}
+
+// count the request of the identity by the global limit, the route limit (disabled when zero) and
+// the rules, the limit which rejected it is returned too. With read the request is not counted, the
+// limits with less than its cost remaining reject it.
+func (dispatch *Dispatcher) check(ctx context.Context, identity string, route RouteLimit, name string, cost int, rules []ruleKey, read bool) (LimitState, *LimitInfo, error) {
+	now := dispatch.clock.Now()
+	routeKey, staticKey := dispatch.buildKeys(name, identity)
+
+	limit, period := dispatch.globalLimit()
+	args := scriptArgs{now: now.UnixMilli(), cost: cost, credit: dispatch.initialCredit, totals: dispatch.totals}
+	args.limits = append(args.limits, scriptLimit{staticKey, limit, dispatch.deadline(now, period, staticKey), dispatch.burst})
+	if route.Limit > 0 {
+		args.limits = append(args.limits, scriptLimit{routeKey, route.Limit, dispatch.deadline(now, route.Duration, routeKey), route.Burst})
+	}
+	for _, rule := range rules {
+		args.limits = append(args.limits, scriptLimit{rule.key, rule.Limit, dispatch.deadline(now, rule.Period, rule.key), 0})
+	}
+	globalCost := cost
+	if route.GlobalMultiplier > 1 {
+		globalCost = cost * route.GlobalMultiplier
+		args.costs = []int{globalCost}
+	}
+	shareKey := dispatch.shareKey(staticKey, name)
+	shareLimit := int(route.GlobalShare * float64(limit))
+	if shareLimit < 1 {
+		shareLimit = 1
+	}
+	if route.GlobalShare > 0 {
+		// the share is counted like the global limit, after the rules
+		args.limits = append(args.limits, scriptLimit{shareKey, shareLimit, dispatch.deadline(now, period, shareKey), 0})
+		if globalCost != cost {
+			for len(args.costs) < len(args.limits)-1 {
+				args.costs = append(args.costs, cost)
+			}
+			args.costs = append(args.costs, globalCost)
+		}
+	}
+
+	run := args
+	if read {
+		run.cost, run.costs, run.totals = 0, nil, false
+	}
+	results, err := dispatch.eval(ctx, run)
+	if err != nil {
+		dispatch.logger.Printf("limiter: redis error: %v", err)
+		return LimitState{}, nil, err
+	}
+
+	windows, err := parseResult(results, len(args.limits))
+	if err != nil {
+		dispatch.logger.Printf("limiter: unexpected script result: %#v", results)
+		return LimitState{}, nil, err
+	}
+	if read {
+		for i := range windows {
+			if windows[i].remaining < int64(args.costOf(i)) {
+				windows[i].remaining = -1
+			}
+		}
+	}
+	static, windows := windows[0], windows[1:]
+	routeWindow := windowResult{}
+	if route.Limit > 0 {
+		routeWindow, windows = windows[0], windows[1:]
+	}
+
+	state := LimitState{
+		GlobalLimit:     limit,
+		GlobalRemaining: remaining(static.remaining),
+		GlobalReset:     static.reset,
+		RouteLimit:      route.Limit,
+		RouteRemaining:  remaining(routeWindow.remaining),
+		RouteReset:      routeWindow.reset,
+		clock:           dispatch.clock,
+	}
+
+	var exceeded *LimitInfo
+	if static.remaining == -1 {
+		exceeded = &LimitInfo{Scope: GlobalScope, Limit: state.GlobalLimit, Reset: static.reset, first: static.first}
+	} else if routeWindow.remaining == -1 {
+		exceeded = &LimitInfo{Scope: RouteScope, Limit: state.RouteLimit, Reset: routeWindow.reset, first: routeWindow.first}
+	}
+	if exceeded != nil {
+		exceeded.StaticKey = staticKey
+		if route.Limit > 0 {
+			exceeded.RouteKey = routeKey
+		}
+	}
+	for i, rule := range rules {
+		state.Rules = append(state.Rules, RuleState{Name: rule.Name, Limit: rule.Limit, Remaining: remaining(windows[i].remaining), Reset: windows[i].reset})
+		if exceeded == nil && windows[i].remaining == -1 {
+			exceeded = &LimitInfo{Scope: rule.Name, Limit: rule.Limit, Reset: windows[i].reset, StaticKey: staticKey, RouteKey: rule.key, first: windows[i].first}
+		}
+	}
+	if share := windows[len(rules):]; len(share) > 0 && exceeded == nil && share[0].remaining == -1 {
+		exceeded = &LimitInfo{Scope: ShareScope, Limit: shareLimit, Reset: share[0].reset, StaticKey: staticKey, RouteKey: shareKey, first: share[0].first}
+	}
+	return state, exceeded, nil
+}
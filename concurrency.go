@@ -0,0 +1,104 @@
+package limiter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ConcurrencyScope is the scope of the requests rejected by MiddleWareConcurrency.
+const ConcurrencyScope = "concurrency"
+
+// scripts used besides the script of the strategy, by their name in the SHA cache
+var otherScripts = map[string]string{
+	ConcurrencyScope: ConcurrencyScript,
+	totalsScript:     TotalsScript,
+}
+
+// MiddleWareConcurrency lets at most max requests of the route (of all the clients) run at once,
+// e.g. to protect a slow handler. The requests over it are rejected like the ones over the route
+// limit with the ConcurrencyScope. The requests which are not limited (see WithSkip, SetBypassMethods
+// and the whitelist) do not count, the blacklisted ones are rejected. A request counts until its handlers return or at most ttl, so
+// that the requests of a process which died do not count forever. LimitError or PeriodError is
+// returned for an invalid max or ttl, the error of redis when the script cannot be loaded.
+func (dispatch *Dispatcher) MiddleWareConcurrency(max int, ttl time.Duration) (gin.HandlerFunc, error) {
+	if max <= 0 {
+		return nil, LimitError
+	}
+	if ttl <= 0 {
+		return nil, PeriodError
+	}
+	if err := dispatch.loadScript(context.Background(), ConcurrencyScope); err != nil {
+		return nil, err
+	}
+	return func(ctx *gin.Context) {
+		if limit, allowed := dispatch.screen(ctx, dispatch.clientIP(ctx)); !limit {
+			if allowed {
+				ctx.Next()
+			}
+			return
+		}
+		// the keys of the clients start with the prefix and "{", so no identity builds this key
+		delimiter := dispatch.keyDelimiter
+		route := ctx.Request.Method + delimiter + dispatch.keyPart(ctx.FullPath())
+		key := dispatch.keyPrefix + "c" + delimiter + "{" + escapeKey(route, "}") + "}"
+		id := requestID()
+
+		now := dispatch.clock.Now()
+		result, err := dispatch.evalScript(ctx.Request.Context(), ConcurrencyScope, []string{key},
+			now.UnixMilli(), ttl.Milliseconds(), max, id, "acquire")
+		if err != nil {
+			dispatch.logger.Printf("limiter: redis error: %v", err)
+			if dispatch.fail(ctx) {
+				ctx.Next()
+			}
+			return
+		}
+		remaining, ok := result.(int64)
+		if !ok {
+			dispatch.logger.Printf("limiter: unexpected script result: %#v", result)
+			if dispatch.fail(ctx) {
+				ctx.Next()
+			}
+			return
+		}
+		if remaining < 0 {
+			if dispatch.metrics != nil {
+				dispatch.metrics.IncRejected(ConcurrencyScope)
+			}
+			if dispatch.dryRun {
+				// the request was not acquired, there is nothing to release
+				dispatch.logger.Printf("limiter: dry run, %s exceeded the %s limit", ctx.Request.URL.Path, ConcurrencyScope)
+				dispatch.setFlagHeader(ctx, DryRunHeader)
+				ctx.Next()
+				return
+			}
+			// the time of the release is unknown, let the client wait a second
+			dispatch.reject(ctx, LimitInfo{Scope: ConcurrencyScope, Limit: max, Reset: now.Add(time.Second), StaticKey: key})
+			return
+		}
+		if dispatch.metrics != nil {
+			dispatch.metrics.IncAllowed(ConcurrencyScope)
+		}
+
+		defer func() {
+			// the request context may be canceled already
+			_, err := dispatch.evalScript(context.Background(), ConcurrencyScope, []string{key},
+				dispatch.clock.Now().UnixMilli(), ttl.Milliseconds(), max, id, "release")
+			if err != nil {
+				dispatch.logger.Printf("limiter: redis error: %v", err)
+			}
+		}()
+		ctx.Next()
+	}, nil
+}
+
+// random id of a request in flight
+func requestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,95 @@
+// Package grpclimiter limits gRPC calls with the global limit of a limiter.Dispatcher, so that the
+// HTTP and the gRPC servers of a service share one configuration and one quota per client.
+package grpclimiter
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	limiter "github.com/katomaso/gin-limiter"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// names of the response metadata of the limit, the reset is in seconds
+const (
+	LimitMetadata     = "x-ratelimit-limit"
+	RemainingMetadata = "x-ratelimit-remaining"
+	ResetMetadata     = "x-ratelimit-reset"
+)
+
+// KeyFunc identifies the client of the call.
+type KeyFunc func(ctx context.Context, info *grpc.UnaryServerInfo) string
+
+// the context key of the dispatcher of the interceptor
+type dispatcherKey struct{}
+
+// PeerKey identifies the client by the IP of the peer, "unknown" when there is none. Within
+// UnaryServerInterceptor the IP is masked like by the middlewares (see limiter.Dispatcher.ClientKey),
+// so that the calls and the HTTP requests of a client share its quota.
+func PeerKey(ctx context.Context, info *grpc.UnaryServerInfo) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "unknown"
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		host = p.Addr.String()
+	}
+	if dispatch, ok := ctx.Value(dispatcherKey{}).(*limiter.Dispatcher); ok {
+		if key := dispatch.ClientKey(host); key != "" {
+			return key
+		}
+		return "unknown"
+	}
+	return host
+}
+
+// MetadataKey identifies the client by the first value of the metadata (e.g. "x-api-key") and
+// falls back to PeerKey when it is missing.
+func MetadataKey(name string) KeyFunc {
+	return func(ctx context.Context, info *grpc.UnaryServerInfo) string {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get(name); len(values) > 0 && values[0] != "" {
+				return values[0]
+			}
+		}
+		return PeerKey(ctx, info)
+	}
+}
+
+// UnaryServerInterceptor limits every call by the global limit of the dispatcher, PeerKey is used
+// when keyFunc is nil. The state of the limit is sent in the response metadata, the throttled calls
+// fail with codes.ResourceExhausted and the calls which could not be checked with codes.Unavailable
+// unless the dispatcher fails open.
+func UnaryServerInterceptor(dispatch *limiter.Dispatcher, keyFunc KeyFunc) grpc.UnaryServerInterceptor {
+	if keyFunc == nil {
+		keyFunc = PeerKey
+	}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		key := keyFunc(context.WithValue(ctx, dispatcherKey{}, dispatch), info)
+		allowed, state, err := dispatch.Allow(ctx, key, 1)
+		if err != nil {
+			if allowed {
+				return handler(ctx, req)
+			}
+			// the error of redis is logged by the dispatcher, it is not for the clients
+			return nil, status.Error(codes.Unavailable, limiter.ServerError.Error())
+		}
+		// the metadata cannot be sent, e.g. the handler sent the header already, which does not
+		// change the limiting
+		_ = grpc.SetHeader(ctx, metadata.Pairs(
+			LimitMetadata, strconv.Itoa(state.GlobalLimit),
+			RemainingMetadata, strconv.Itoa(state.GlobalRemaining),
+			ResetMetadata, strconv.Itoa(state.SecondsUntilReset()),
+		))
+		if !allowed {
+			return nil, status.Errorf(codes.ResourceExhausted, "rate limited, retry in %d seconds", state.SecondsUntilReset())
+		}
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,99 @@
+package grpclimiter
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	limiter "github.com/katomaso/gin-limiter"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// health client of a server limited by the dispatcher of the limit on a new miniredis server
+func testClient(t *testing.T, limit int) (client healthpb.HealthClient, dispatch *limiter.Dispatcher, server *miniredis.Miniredis) {
+	t.Helper()
+	server = miniredis.RunT(t)
+	dispatch, err := limiter.LimitDispatcher(time.Minute, limit, redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(UnaryServerInterceptor(dispatch, MetadataKey("x-api-key"))))
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return healthpb.NewHealthClient(conn), dispatch, server
+}
+
+// check the health as the client of the key, header is the response metadata
+func check(client healthpb.HealthClient, key string) (header metadata.MD, err error) {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", key)
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+	return header, err
+}
+
+func TestResourceExhausted(t *testing.T) {
+	client, _, _ := testClient(t, 2)
+	for _, want := range []string{"1", "0"} {
+		header, err := check(client, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := header.Get(RemainingMetadata); len(got) != 1 || got[0] != want {
+			t.Errorf("remaining %v, want %s", got, want)
+		}
+		if got := header.Get(LimitMetadata); len(got) != 1 || got[0] != "2" {
+			t.Errorf("limit %v, want 2", got)
+		}
+		if got := header.Get(ResetMetadata); len(got) != 1 || got[0] != "60" {
+			t.Errorf("reset %v, want 60", got)
+		}
+	}
+	header, err := check(client, "a")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("error %v, want ResourceExhausted", err)
+	}
+	if got := header.Get(RemainingMetadata); len(got) != 1 || got[0] != "0" {
+		t.Errorf("remaining %v of the rejected call, want 0", got)
+	}
+
+	// the quota is per key
+	if _, err := check(client, "b"); err != nil {
+		t.Errorf("error %v of another key", err)
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	client, dispatch, server := testClient(t, 2)
+	server.Close()
+
+	_, err := check(client, "a")
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("error %v, want Unavailable", err)
+	}
+	if message := status.Convert(err).Message(); message != limiter.ServerError.Error() {
+		t.Errorf("message %q, want %q", message, limiter.ServerError.Error())
+	}
+
+	dispatch.WithFailOpen(true)
+	if _, err := check(client, "a"); err != nil {
+		t.Errorf("error %v, want the call when failing open", err)
+	}
+}
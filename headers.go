@@ -0,0 +1,180 @@
+package limiter
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// names of the single-tier headers of the IETF RateLimit header fields draft
+const (
+	StandardLimitHeader     = "RateLimit-Limit"
+	StandardRemainingHeader = "RateLimit-Remaining"
+	StandardResetHeader     = "RateLimit-Reset"
+	StandardPolicyHeader    = "RateLimit-Policy"
+)
+
+// DryRunHeader is set on the requests which exceeded a limit in the dry run mode.
+const DryRunHeader = "X-RateLimit-DryRun-Exceeded"
+
+// WarningHeader is set on the requests which reached the soft limit, see WithSoftLimit.
+const WarningHeader = "X-RateLimit-Warning"
+
+// BypassedHeader is set to "backend-unavailable" on the requests let through by WithFailOpen,
+// see WithBypassedHeader.
+const BypassedHeader = "X-RateLimit-Bypassed"
+
+// ResetFormat is the format of the reset headers.
+type ResetFormat int
+
+const (
+	// ResetTime is the local time in TimeFormat, the default.
+	ResetTime ResetFormat = iota
+	// ResetUnix is the unix time in seconds.
+	ResetUnix
+	// ResetSeconds is the number of seconds until the reset.
+	ResetSeconds
+)
+
+// HeaderNames are the names of the rate limit headers, headers with an empty name are not written.
+type HeaderNames struct {
+	GlobalLimit     string
+	GlobalRemaining string
+	GlobalReset     string
+	RouteLimit      string
+	RouteRemaining  string
+	RouteReset      string
+}
+
+// PrefixedHeaderNames returns the header names of both limits starting with the prefix,
+// e.g. prefix "X-RateLimit-" gives "X-RateLimit-Limit-global".
+func PrefixedHeaderNames(prefix string) HeaderNames {
+	return HeaderNames{
+		GlobalLimit:     prefix + "Limit-global",
+		GlobalRemaining: prefix + "Remaining-global",
+		GlobalReset:     prefix + "Reset-global",
+		RouteLimit:      prefix + "Limit-route",
+		RouteRemaining:  prefix + "Remaining-route",
+		RouteReset:      prefix + "Reset-route",
+	}
+}
+
+// DefaultHeaderNames are the headers written by default.
+var DefaultHeaderNames = PrefixedHeaderNames("X-RateLimit-")
+
+// WithHeaderNames sets the names of the rate limit headers.
+func (dispatch *Dispatcher) WithHeaderNames(names HeaderNames) *Dispatcher {
+	dispatch.headerNames = names
+	dispatch.standardHeaders = false
+	return dispatch
+}
+
+// WithResetFormat sets the format of the reset headers, the standard headers always use seconds.
+func (dispatch *Dispatcher) WithResetFormat(format ResetFormat) *Dispatcher {
+	dispatch.resetFormat = format
+	return dispatch
+}
+
+// WithDisableHeaders stops the middlewares from writing the X-RateLimit-* headers (including the
+// standard ones, the policy, the warning and the dry run one) to not reveal the limits. Retry-After
+// of the rejected requests is still written.
+func (dispatch *Dispatcher) WithDisableHeaders(disable bool) *Dispatcher {
+	dispatch.disableHeaders = disable
+	return dispatch
+}
+
+// WithStandardHeaders switches to the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+// headers of the IETF draft. They describe the limit (global or route) closer to be reached and
+// the reset is in seconds.
+func (dispatch *Dispatcher) WithStandardHeaders() *Dispatcher {
+	dispatch.standardHeaders = true
+	return dispatch
+}
+
+// WithPolicyHeader writes the RateLimit-Policy header of the IETF draft with the limits of the
+// request and their periods in seconds, e.g. "100;w=60, 10;w=1" for the global and the route limit.
+// It is written with both the standard and the X-RateLimit-* headers.
+func (dispatch *Dispatcher) WithPolicyHeader(policy bool) *Dispatcher {
+	dispatch.policyHeader = policy
+	return dispatch
+}
+
+// WithBypassedHeader sets the BypassedHeader on the requests let through without limiting because
+// redis could not be reached (see WithFailOpen), e.g. to count them.
+func (dispatch *Dispatcher) WithBypassedHeader(bypassed bool) *Dispatcher {
+	dispatch.bypassedHeader = bypassed
+	return dispatch
+}
+
+// write the policy header of the global limit, the route limit (if any) and the rules
+func (dispatch *Dispatcher) setPolicyHeader(ctx *gin.Context, route RouteLimit, rules []Rule) {
+	if dispatch.disableHeaders || !dispatch.policyHeader {
+		return
+	}
+	limit, period := dispatch.globalLimit()
+	policies := []string{policy(limit, period)}
+	if route.Limit > 0 {
+		policies = append(policies, policy(route.Limit, route.Duration))
+	}
+	for _, rule := range rules {
+		policies = append(policies, policy(rule.Limit, rule.Period))
+	}
+	ctx.Header(StandardPolicyHeader, strings.Join(policies, ", "))
+}
+
+// the limit and its window in seconds, rounded up
+func policy(limit int, period time.Duration) string {
+	return strconv.Itoa(limit) + ";w=" + strconv.Itoa(int(math.Ceil(period.Seconds())))
+}
+
+// write the rate limit headers of both the allowed and the rejected requests, the remaining
+// of a reached limit is 0 and so the standard headers describe the reached limit
+func (dispatch *Dispatcher) setRateHeaders(ctx *gin.Context, state LimitState) {
+	if dispatch.disableHeaders {
+		return
+	}
+	if dispatch.standardHeaders {
+		limit, remaining, _ := state.closest()
+		ctx.Header(StandardLimitHeader, strconv.Itoa(limit))
+		ctx.Header(StandardRemainingHeader, strconv.Itoa(remaining))
+		ctx.Header(StandardResetHeader, strconv.Itoa(state.SecondsUntilReset()))
+		return
+	}
+
+	names := dispatch.headerNames
+	setHeader(ctx, names.GlobalLimit, strconv.Itoa(state.GlobalLimit))
+	setHeader(ctx, names.GlobalRemaining, strconv.Itoa(state.GlobalRemaining))
+	setHeader(ctx, names.GlobalReset, dispatch.formatReset(state.GlobalReset))
+	if state.RouteLimit > 0 {
+		setHeader(ctx, names.RouteLimit, strconv.Itoa(state.RouteLimit))
+		setHeader(ctx, names.RouteRemaining, strconv.Itoa(state.RouteRemaining))
+		setHeader(ctx, names.RouteReset, dispatch.formatReset(state.RouteReset))
+	}
+}
+
+func (dispatch *Dispatcher) formatReset(reset time.Time) string {
+	switch dispatch.resetFormat {
+	case ResetUnix:
+		return strconv.FormatInt(reset.Unix(), 10)
+	case ResetSeconds:
+		return strconv.Itoa(secondsUntil(dispatch.clock.Now(), reset))
+	default:
+		return reset.Format(TimeFormat)
+	}
+}
+
+// write the header unless the headers are disabled
+func (dispatch *Dispatcher) setFlagHeader(ctx *gin.Context, name string) {
+	if !dispatch.disableHeaders {
+		ctx.Header(name, "true")
+	}
+}
+
+func setHeader(ctx *gin.Context, name, value string) {
+	if name != "" {
+		ctx.Header(name, value)
+	}
+}
@@ -0,0 +1,122 @@
+package limiter
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetTrustedProxies makes the limiter resolve the client IP from the X-Forwarded-For header itself,
+// independently of the trusted proxies of gin. The header is read from right to left and the first
+// IP which is not one of the proxies (IPs or CIDR ranges) is the client, so a client cannot dodge
+// the limits by sending a forged header. FormatError is returned for an invalid entry.
+func (dispatch *Dispatcher) SetTrustedProxies(proxies []string) error {
+	ipNets, err := parseIPNets(proxies)
+	if err != nil {
+		return err
+	}
+	dispatch.trustedProxies = ipNets
+	return nil
+}
+
+// SetIPPrefix sets the prefix lengths to which the client IPs are masked before building the keys,
+// /32 for IPv4 and /64 for IPv6 by default since a single IPv6 client usually controls a whole /64.
+// Use 32 and 128 to limit every address on its own. FormatError is returned for an invalid length.
+func (dispatch *Dispatcher) SetIPPrefix(ipv4, ipv6 int) error {
+	if ipv4 <= 0 || ipv4 > 8*net.IPv4len {
+		return fmt.Errorf("%w Invalid IPv4 prefix length %d.", FormatError, ipv4)
+	}
+	if ipv6 <= 0 || ipv6 > 8*net.IPv6len {
+		return fmt.Errorf("%w Invalid IPv6 prefix length %d.", FormatError, ipv6)
+	}
+	dispatch.ipv4Prefix = ipv4
+	dispatch.ipv6Prefix = ipv6
+	return nil
+}
+
+// ClientKey returns the key of the client IP as the middlewares use it, masked by the prefixes of
+// SetIPPrefix, so that e.g. Allow shares the quota of the client with the middlewares. An invalid IP
+// is the unknown client of WithUnknownClientKey.
+func (dispatch *Dispatcher) ClientKey(ip string) string {
+	if parsed := net.ParseIP(strings.TrimSpace(ip)); parsed != nil {
+		return dispatch.maskIP(parsed)
+	}
+	return dispatch.unknownClientKey
+}
+
+// get the network of the ip by the prefix length
+func (dispatch *Dispatcher) maskIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(dispatch.ipv4Prefix, 8*net.IPv4len)).String()
+	}
+	return ip.Mask(net.CIDRMask(dispatch.ipv6Prefix, 8*net.IPv6len)).String()
+}
+
+// get the IP of the client, ctx.ClientIP() unless trusted proxies are set
+func (dispatch *Dispatcher) clientIP(ctx *gin.Context) string {
+	if len(dispatch.trustedProxies) == 0 {
+		return ctx.ClientIP()
+	}
+	remoteIP, _, err := net.SplitHostPort(strings.TrimSpace(ctx.Request.RemoteAddr))
+	if err != nil {
+		remoteIP = strings.TrimSpace(ctx.Request.RemoteAddr)
+	}
+	if !containsIP(dispatch.trustedProxies, remoteIP) {
+		return remoteIP
+	}
+	hops := strings.Split(ctx.GetHeader("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		if !containsIP(dispatch.trustedProxies, hop) {
+			return hop
+		}
+		remoteIP = hop
+	}
+	// all the hops are trusted proxies, the farthest one is the client
+	return remoteIP
+}
+
+// parse single IPs and CIDR ranges
+func parseIPNets(entries []string) ([]*net.IPNet, error) {
+	ipNets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%w Invalid CIDR %q.", FormatError, entry)
+			}
+			ipNets = append(ipNets, ipNet)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("%w Invalid IP %q.", FormatError, entry)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		ipNets = append(ipNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return ipNets, nil
+}
+
+// check if the ip is in one of the networks
+func containsIP(ipNets []*net.IPNet, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range ipNets {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,223 @@
+package limiter
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Route identifies the route limit of a client for ResetClient.
+type Route struct {
+	Path   string // full path of the route, as ctx.FullPath()
+	Method string
+	Bucket string // name of the bucket of MiddleWareNamed, Path and Method are ignored when set
+	Tier   string // tier of MiddleWareTiers
+}
+
+// ResetClient clears the global limit of the client identified by key (its IP or the result of
+// the key function) and its limits of the routes, so that its quota resets immediately.
+func (dispatch *Dispatcher) ResetClient(ctx context.Context, key string, routes ...Route) error {
+	_, staticKey := dispatch.buildKeys("", key)
+	keys := []string{staticKey}
+	for _, route := range routes {
+		name := dispatch.routeNameOf(route)
+		routeKey, _ := dispatch.buildKeys(name, key)
+		keys = append(keys, routeKey, dispatch.shareKey(staticKey, name))
+	}
+	for _, key := range keys {
+		keys = append(keys, "!"+key, "#"+key) // the flags of the first rejection and the totals
+	}
+	// the fallbacks may hold limits of the client from a failover too
+	var err error
+	for _, client := range dispatch.clients() {
+		if delErr := client.Del(ctx, keys...).Err(); delErr != nil && err == nil {
+			err = delErr
+		}
+	}
+	return err
+}
+
+// name of the route in its keys, the method in any case like the methods of the requests
+func (dispatch *Dispatcher) routeNameOf(route Route) string {
+	return dispatch.routeName(RouteLimit{Bucket: route.Bucket, tier: route.Tier}, route.Path, strings.ToUpper(route.Method))
+}
+
+// BuildKey returns the redis keys of the route limit and of the global limit of the request exactly
+// as the middlewares build them (with the key function, the IP prefixes and the unmatched routes),
+// e.g. to inspect or clear them in redis. The route key is that of MiddleWare, not of the buckets, the tiers
+// or the rules, it is empty for an unmatched request with UnmatchedSkip. Both are empty when the
+// request has no identity (see WithRequireKey and WithUnknownClientKey).
+func (dispatch *Dispatcher) BuildKey(ctx *gin.Context) (routeKey, staticKey string) {
+	identity, err := dispatch.identity(ctx, RouteLimit{}, dispatch.clientIP(ctx))
+	if err != nil {
+		return "", ""
+	}
+	path, matched := dispatch.routePath(ctx, RouteLimit{})
+	routeKey, staticKey = dispatch.buildKeys(dispatch.routeName(RouteLimit{}, path, ctx.Request.Method), identity)
+	if !matched {
+		routeKey = ""
+	}
+	return routeKey, staticKey
+}
+
+// BuildKeyFor returns the keys of BuildKey for a request of the client IP to the full path of the
+// route (as ctx.FullPath()) without a key function. An invalid IP is the unknown client.
+func (dispatch *Dispatcher) BuildKeyFor(ip, path, method string) (routeKey, staticKey string) {
+	identity := dispatch.ClientKey(ip)
+	if identity == "" {
+		return "", ""
+	}
+	return dispatch.buildKeys(dispatch.routeName(RouteLimit{}, path, strings.ToUpper(method)), identity)
+}
+
+// path of the request in the route key, false when the request matches no route and the route
+// limits skip it (see WithUnmatchedRoutes)
+func (dispatch *Dispatcher) routePath(ctx *gin.Context, route RouteLimit) (string, bool) {
+	path := ctx.FullPath()
+	if path != "" || route.Bucket != "" {
+		return path, true
+	}
+	switch dispatch.unmatchedRoutes {
+	case UnmatchedSkip:
+		return path, false
+	case UnmatchedPath:
+		return ctx.Request.URL.Path, true
+	}
+	return path, true
+}
+
+// WithKeyPrefix prefixes all the redis keys of the limiter (e.g. "myapp:rl:") so that
+// several applications can share one redis.
+func (dispatch *Dispatcher) WithKeyPrefix(prefix string) *Dispatcher {
+	dispatch.keyPrefix = prefix
+	return dispatch
+}
+
+// DefaultKeyDelimiter separates the parts of the route keys.
+const DefaultKeyDelimiter = ":"
+
+// WithKeyDelimiter sets the separator of the parts of the route keys (e.g. "|" for the tooling of
+// the redis), DefaultKeyDelimiter when empty. The parts containing it are escaped with "\".
+func (dispatch *Dispatcher) WithKeyDelimiter(delimiter string) *Dispatcher {
+	if delimiter == "" {
+		delimiter = DefaultKeyDelimiter
+	}
+	dispatch.keyDelimiter = delimiter
+	return dispatch
+}
+
+// WithIgnoreMethodInKey makes all the methods of a route share its route limit, e.g. GET and POST
+// of /users/:id, the route limits are per method by default. The Method of Route is ignored then.
+func (dispatch *Dispatcher) WithIgnoreMethodInKey(ignore bool) *Dispatcher {
+	dispatch.ignoreMethod = ignore
+	return dispatch
+}
+
+// WithHashedKeys replaces the identities and the paths of the route keys by their SHA-1 in hex
+// (40 characters), so that the keys of long identities (e.g. JWT subjects) or URL paths (see
+// UnmatchedPath) are short. The prefix and the parts naming the limits stay readable, e.g.
+// "{<sha1>}:r:GET:<sha1>". The limits counted before are not found after it changes.
+func (dispatch *Dispatcher) WithHashedKeys(hash bool) *Dispatcher {
+	dispatch.hashKeys = hash
+	return dispatch
+}
+
+// hash the variable part of a key with WithHashedKeys
+func (dispatch *Dispatcher) keyPart(part string) string {
+	if !dispatch.hashKeys {
+		return part
+	}
+	sum := sha1.Sum([]byte(part))
+	return hex.EncodeToString(sum[:])
+}
+
+// UnmatchedRoutes is how the route limits count the requests which match no route (e.g. of a limit
+// registered by router.Use), their ctx.FullPath() is empty.
+type UnmatchedRoutes int
+
+const (
+	// UnmatchedShared counts all the unmatched requests of a method in one route limit, the default.
+	UnmatchedShared UnmatchedRoutes = iota
+	// UnmatchedSkip limits the unmatched requests only by the global limit and the rules.
+	UnmatchedSkip
+	// UnmatchedPath counts every URL path on its own. Mind that the clients choose the paths, so
+	// they can create any number of keys.
+	UnmatchedPath
+)
+
+// WithUnmatchedRoutes sets how the route limits count the requests which match no route.
+func (dispatch *Dispatcher) WithUnmatchedRoutes(unmatched UnmatchedRoutes) *Dispatcher {
+	dispatch.unmatchedRoutes = unmatched
+	return dispatch
+}
+
+// build the redis keys of the route limit and of the global limit. The identity is a hash tag
+// right after the prefix - both keys start with the same "{" so they always hash to the same
+// cluster slot and the scripts can use them together on a Redis Cluster. The "}" in the identity
+// is escaped so that the tag of one identity never ends inside another one.
+func (dispatch *Dispatcher) buildKeys(route, identity string) (routeKey, staticKey string) {
+	identity = dispatch.keyPart(identity)
+	staticKey = dispatch.keyPrefix + "{" + escapeKey(identity, "}") + "}" // for global limit search in redis.
+	routeKey = staticKey + route                                          // for single route limit in redis.
+	return routeKey, staticKey
+}
+
+// name of the route in the route key, the parts are
+//
+//	:t:<tier>        the tier of MiddleWareTiers, if any
+//	:b:<bucket>      the named bucket or
+//	:r:<method>:<path> or
+//	:p:<path>        with WithIgnoreMethodInKey
+//
+// joined by the delimiter, the rules of MiddleWareRules are :n:<rule> and the global shares :s<name>.
+// The tier and the bucket are escaped and the path is the last part, so two different routes never
+// share a key.
+func (dispatch *Dispatcher) routeName(route RouteLimit, path, method string) string {
+	delimiter := dispatch.keyDelimiter
+	name := ""
+	if route.tier != "" {
+		name = delimiter + "t" + delimiter + escapeKey(route.tier, delimiter)
+	}
+	if route.Bucket != "" {
+		return name + delimiter + "b" + delimiter + escapeKey(route.Bucket, delimiter)
+	}
+	if dispatch.ignoreMethod {
+		return name + delimiter + "p" + delimiter + dispatch.keyPart(path)
+	}
+	return name + delimiter + "r" + delimiter + method + delimiter + dispatch.keyPart(path)
+}
+
+// key of the global share of the route of the name, :s<name>
+func (dispatch *Dispatcher) shareKey(staticKey, name string) string {
+	return staticKey + dispatch.keyDelimiter + "s" + name
+}
+
+// escape the separator and the escape character in the part of a key
+func escapeKey(part, separator string) string {
+	return strings.NewReplacer(`\`, `\\`, separator, `\`+separator).Replace(part)
+}
+
+// Peek returns the remaining global quota of the client identified by key and the time of its
+// reset without consuming it.
+func (dispatch *Dispatcher) Peek(ctx context.Context, key string) (int, time.Time, error) {
+	_, staticKey := dispatch.buildKeys("", key)
+	now := dispatch.clock.Now()
+	limit, period := dispatch.globalLimit()
+	results, err := dispatch.eval(ctx, scriptArgs{
+		now:    now.UnixMilli(),
+		limits: []scriptLimit{{staticKey, limit, dispatch.deadline(now, period, staticKey), dispatch.burst}},
+		credit: dispatch.initialCredit,
+	})
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	windows, err := parseResult(results, 1)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return remaining(windows[0].remaining), windows[0].reset, nil
+}
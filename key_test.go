@@ -0,0 +1,27 @@
+package limiter
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestResetClientMethodCase(t *testing.T) {
+	dispatch, _, _ := testDispatcher(t, FixedWindow, time.Minute, 10)
+	router := gin.New()
+	router.GET("/a", dispatch.MiddleWare(time.Minute, 1), func(ctx *gin.Context) { ctx.String(http.StatusOK, "ok") })
+
+	get(router, "/a")
+	if code := get(router, "/a").Code; code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want the route limit reached", code)
+	}
+	if err := dispatch.ResetClient(context.Background(), dispatch.ClientKey("1.2.3.4"), Route{Path: "/a", Method: "get"}); err != nil {
+		t.Fatal(err)
+	}
+	if code := get(router, "/a").Code; code != http.StatusOK {
+		t.Errorf("status %d after the reset, want 200", code)
+	}
+}
@@ -1,11 +1,19 @@
 package limiter
 
 import (
+	"bytes"
 	"context"
 	"errors"
-	"log"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -18,140 +26,1351 @@ const TimeFormat = "2006-01-02 15:04:05"
 // self define error
 var (
 	LimitError   = errors.New("Limit should > 0.")
+	PeriodError  = errors.New("Period should > 0.")
+	RedisError   = errors.New("The redis client should not be nil.")
 	CommandError = errors.New("The command of first number should > 0.")
 	FormatError  = errors.New("Please check the format with your input.")
 	MethodError  = errors.New("Please check the method is one of http method.")
 	ServerError  = errors.New("StatusInternalServerError, please wait a minute.")
+	ResultError  = errors.New("Unexpected result of the limiter script.")
+	ClosedError  = errors.New("The limiter is closed.")
+	TierError    = errors.New("The tier of the request has no limit.")
+	ClientError  = errors.New("The client IP could not be resolved, please check the proxy configuration.")
+	KeyError     = errors.New("The key function returned an empty key, please check the order of the middlewares.")
+	ScanError    = errors.New("The redis client cannot list the keys, it has no Scan.")
+
+	// RateLimitedError is added to the errors of the gin context of the rejected requests, with their
+	// LimitInfo as the meta, for the error handling middlewares.
+	RateLimitedError = errors.New("The rate limit is reached.")
+)
+
+// Strategy is the algorithm used to count the requests of a client.
+type Strategy string
+
+const (
+	// FixedWindow allows limit requests until the window, started by the first request, expires.
+	FixedWindow Strategy = "normal"
+	// SlidingWindow allows limit requests within any period long interval.
+	SlidingWindow Strategy = "sliding"
+	// TokenBucket gives each client a bucket of limit tokens which is continuously refilled so
+	// that it is full again after period. Every request takes one token.
+	TokenBucket Strategy = "bucket"
+	// LeakyBucket gives each client a bucket of limit capacity which every request fills and which
+	// leaks so that it is empty again after period. Requests overflowing the bucket are rejected.
+	LeakyBucket Strategy = "leaky"
+)
+
+// lua script of each strategy
+var strategyScripts = map[Strategy]string{
+	FixedWindow:   Script,
+	SlidingWindow: SlidingScript,
+	TokenBucket:   TokenBucketScript,
+	LeakyBucket:   LeakyBucketScript,
+}
+
+// scope of the limit
+const (
+	GlobalScope = "global"
+	RouteScope  = "route"
+	ShareScope  = "share" // the global share of a route, see RouteLimit.GlobalShare
+)
+
+// LimitInfo describes the limit which rejected the request. The keys and the client IP identify
+// the client (they are personal data in many jurisdictions), mind it before logging them.
+type LimitInfo struct {
+	Scope string // GlobalScope, RouteScope, ShareScope, ConcurrencyScope or the name of the rule
+	Limit int
+	Reset time.Time
+
+	StaticKey string // redis key of the global limit
+	RouteKey  string // redis key of the route limit or of the rule, empty without one
+	ClientIP  string // empty outside of the middlewares
+
+	first bool // the first rejection by the limit until its reset
+}
+
+// RejectResponse is the body of the rejected requests written by the middlewares.
+type RejectResponse int
+
+const (
+	// RejectJSON is the RejectBody (with the fields of SetRejectFields), the default.
+	RejectJSON RejectResponse = iota
+	// RejectText is a line of plain text with the scope and the seconds until the reset.
+	RejectText
+	// RejectEmpty is no body, only the status and the headers.
+	RejectEmpty
 )
 
+// RejectBody is the JSON body of the rejected requests unless OnLimitReached is set or the fields
+// are renamed by SetRejectFields.
+type RejectBody struct {
+	Error      string `json:"error"` // always "rate_limited"
+	Scope      string `json:"scope"`
+	RetryAfter int    `json:"retry_after"` // seconds
+	Reset      string `json:"reset"`       // in the reset format of the headers
+}
+
+// RejectFields are the names of the fields of RejectBody in the JSON, e.g. to match the error
+// envelope of the other responses. Error and RetryAfter are required, the fields with an empty
+// name are not written.
+type RejectFields struct {
+	Error      string
+	Scope      string
+	RetryAfter string
+	Reset      string
+}
+
+// DefaultRejectFields are the names of the fields written by default.
+var DefaultRejectFields = RejectFields{Error: "error", Scope: "scope", RetryAfter: "retry_after", Reset: "reset"}
+
+// RedisClient is the part of the go-redis clients used by the limiter, redis.UniversalClient
+// implements it. Tests can use a fake returning canned results, e.g. redis.NewCmdResult.
+type RedisClient interface {
+	Ping(ctx context.Context) *redis.StatusCmd
+	ScriptLoad(ctx context.Context, script string) *redis.StringCmd
+	EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd
+	Del(ctx context.Context, keys ...string) *redis.IntCmd
+}
+
+// Clock is the source of the current time of the limiter, e.g. a fake clock to test the window
+// resets. The time is passed to the scripts, so the time of redis does not matter.
+type Clock interface {
+	Now() time.Time
+}
+
+// the time of the system
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// Logger is used to report errors of the limiter, *log.Logger implements it.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
 type Dispatcher struct {
 	limit       int
-	deadline    int64
-	shaScript   map[string]string
 	period      time.Duration
-	redisClient *redis.Client
+	limitMu     sync.RWMutex // limit and period can be changed at runtime
+	strategy    Strategy
+	script      string // source of the script of the strategy
+	shaScript   map[string]string
+	scriptMu    sync.RWMutex
+	scripts     *ScriptCache                // shared with other dispatchers
+	reloads     map[scriptKey]*scriptReload // reloads in progress
+	reloadMu    sync.Mutex
+	closed      bool
+	redisClient RedisClient
+	fallbacks   []RedisClient // tried in order when redisClient fails
+	local       *localLimiter // limits in memory when all of them fail
+
+	initialCredit float64 // fraction of the capacity new token buckets start with
+	burst         int     // added to the global limit of the first fixed window after idle
+
+	keyFunc          func(*gin.Context) string
+	requireKey       bool   // reject the requests of an empty key
+	unknownClientKey string // key of the clients without IP
+	keyPrefix        string
+	keyDelimiter     string
+	unmatchedRoutes  UnmatchedRoutes
+	ignoreMethod     bool // the methods of a route share the route limit
+	hashKeys         bool // the identities and the paths are hashed in the keys
+	costFunc         func(*gin.Context) int
+	countResponse    func(status int) bool // count the requests after the response when set
+	skip             func(*gin.Context) bool
+	bypassMethods    map[string]bool
+	failOpen         bool
+	errorStatus      int // status of the requests failed because of redis
+	errorRetryAfter  time.Duration
+	logger           Logger
+	clock            Clock
+	timeout          time.Duration
+	retries          int // of the transient redis errors
+	retryBackoff     time.Duration
+	jitter           time.Duration // maximum shift of the fixed windows
+	alignWindows     bool
+	dryRun           bool
+	totals           bool // count all the requests, see WithTotals
+	metrics          Metrics
+
+	whitelist       []*net.IPNet
+	blacklist       []*net.IPNet
+	blacklistStatus int
+	trustedProxies  []*net.IPNet // resolve the client IP from X-Forwarded-For when set
+	ipv4Prefix      int          // the clients of the same network share the limits
+	ipv6Prefix      int
+
+	headerNames     HeaderNames
+	resetFormat     ResetFormat
+	standardHeaders bool
+	disableHeaders  bool
+	policyHeader    bool
+	bypassedHeader  bool
+	onLimitReached  func(*gin.Context, LimitInfo)
+	onFirstExceeded func(*gin.Context, LimitInfo)
+	softLimit       float64 // fraction of a limit consumed before the warning
+	onSoftLimit     func(*gin.Context, LimitInfo)
+
+	globalRejectStatus int
+	routeRejectStatus  int
+	rejectResponse     RejectResponse
+	rejectFields       RejectFields
 }
 
 // LimitDispatcher limits number of request (`limit`) for `duration` time - that means that only
-// limit requests will be allowed within `duration`
-func LimitDispatcher(duration time.Duration, limit int, rdb *redis.Client) (*Dispatcher, error) {
-	if limit <= 0 {
+// limit requests will be allowed within `duration`. Every client has its own window which starts
+// with its first request. The client can be a *redis.Client, *redis.ClusterClient or a failover client.
+func LimitDispatcher(duration time.Duration, limit int, rdb RedisClient) (*Dispatcher, error) {
+	return New(Config{Redis: rdb, Period: duration, Limit: limit})
+}
+
+// LimitDispatcherSliding limits number of request (`limit`) within any `duration` long interval.
+// Unlike LimitDispatcher it does not allow bursts of up to 2*limit requests around the window reset.
+func LimitDispatcherSliding(duration time.Duration, limit int, rdb RedisClient) (*Dispatcher, error) {
+	return New(Config{Redis: rdb, Strategy: SlidingWindow, Period: duration, Limit: limit})
+}
+
+// LimitTokenBucket gives every client a bucket of `capacity` tokens which is refilled with one
+// token every `rate`. Each request takes a token, so the client can send bursts of up to `capacity`
+// requests but only one request per `rate` in the long run. Route limits of MiddleWare(duration, limit)
+// are buckets of `limit` tokens which are fully refilled within `duration`.
+func LimitTokenBucket(rate time.Duration, capacity int, rdb RedisClient) (*Dispatcher, error) {
+	return New(Config{Redis: rdb, Strategy: TokenBucket, Period: rate * time.Duration(capacity), Limit: capacity})
+}
+
+// LimitLeakyBucket gives every client a bucket of `capacity` requests which leaks one request every
+// `leakRate`. The requests which would overflow the bucket are rejected, with Retry-After saying when
+// there is room again. Route limits of MiddleWare(duration, limit) are buckets of `limit` requests
+// which leak completely within `duration`.
+func LimitLeakyBucket(leakRate time.Duration, capacity int, rdb RedisClient) (*Dispatcher, error) {
+	return New(Config{Redis: rdb, Strategy: LeakyBucket, Period: leakRate * time.Duration(capacity), Limit: capacity})
+}
+
+// LimitBandwidth limits the bytes of the request bodies to `bytesPerPeriod` within `period` with fixed
+// windows, the cost of a request is its Content-Length. The bodies of unknown length (chunked) are
+// rejected, so that they are not buffered in memory; use WithCostFunc(RequestSizeUpTo(max)) with a
+// small max to accept them. The limits of MiddleWare(duration, limit) and the rate limit headers are
+// in bytes too. It is meant for the upload endpoints. LimitError is returned when bytesPerPeriod
+// does not fit an int.
+func LimitBandwidth(bytesPerPeriod int64, period time.Duration, rdb RedisClient) (*Dispatcher, error) {
+	if bytesPerPeriod >= math.MaxInt {
 		return nil, LimitError
 	}
-	dispatcher := new(Dispatcher)
-	_, err := rdb.Ping(context.Background()).Result()
+	dispatcher, err := New(Config{Redis: rdb, Period: period, Limit: int(bytesPerPeriod)})
 	if err != nil {
 		return nil, err
 	}
-	dispatcher.redisClient = rdb
-	dispatcher.period = duration
-	dispatcher.limit = limit
+	return dispatcher.WithCostFunc(func(ctx *gin.Context) int {
+		if ctx.Request.ContentLength < 0 {
+			// more than any limit of the dispatcher
+			return dispatcher.GetLimit() + 1
+		}
+		return int(ctx.Request.ContentLength)
+	}), nil
+}
+
+// LimitDispatcherFailover is LimitDispatcher which runs the limits on the first redis client and
+// fails over to the next ones in order when it cannot be reached. The script is loaded into all
+// of them. RedisError is returned when there is no client.
+func LimitDispatcherFailover(duration time.Duration, limit int, rdbs []RedisClient) (*Dispatcher, error) {
+	if len(rdbs) == 0 {
+		return nil, RedisError
+	}
+	return New(Config{Redis: rdbs[0], Fallbacks: rdbs[1:], Period: duration, Limit: limit})
+}
+
+// check for nil including the nil pointers of the go-redis clients
+func isNilClient(rdb RedisClient) bool {
+	switch client := rdb.(type) {
+	case nil:
+		return true
+	case *redis.Client:
+		return client == nil
+	case *redis.ClusterClient:
+		return client == nil
+	case *redis.Ring:
+		return client == nil
+	}
+	return false
+}
+
+// ScriptCache holds the SHAs of the loaded scripts by their source. The dispatchers sharing one
+// (see Config.ScriptCache) load every script only once, e.g. the many dispatchers of the route
+// specific limits of one redis. A script missing in one of the redis servers is loaded again by
+// the first request which needs it.
+type ScriptCache struct {
+	mu   sync.Mutex
+	shas map[string]string
+}
 
-	resetSHA, err := dispatcher.redisClient.ScriptLoad(context.Background(), ResetScript).Result()
+// NewScriptCache creates an empty ScriptCache.
+func NewScriptCache() *ScriptCache {
+	return &ScriptCache{shas: make(map[string]string)}
+}
+
+func (cache *ScriptCache) get(script string) (string, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	sha, ok := cache.shas[script]
+	return sha, ok
+}
+
+func (cache *ScriptCache) set(script, sha string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.shas[script] = sha
+}
+
+// ScriptCache returns the cache of the scripts of the dispatcher to share it with other dispatchers.
+func (dispatch *Dispatcher) ScriptCache() *ScriptCache {
+	return dispatch.scripts
+}
+
+// load the script of the name (the strategy or one of otherScripts) into redis and the fallbacks,
+// unless the script cache holds it already
+func (dispatch *Dispatcher) loadScript(ctx context.Context, name string) error {
+	script := dispatch.scriptSource(name)
+	if sha, ok := dispatch.scripts.get(script); ok {
+		return dispatch.setSHA(name, script, sha)
+	}
+	for _, client := range dispatch.clients() {
+		if err := dispatch.loadScriptOn(ctx, client, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load the script into the redis client, the SHA is the same on all of them
+func (dispatch *Dispatcher) loadScriptOn(ctx context.Context, client RedisClient, name string) error {
+	script := dispatch.scriptSource(name)
+	sha, err := client.ScriptLoad(ctx, script).Result()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	dispatch.scripts.set(script, sha)
+	return dispatch.setSHA(name, script, sha)
+}
+
+// the source of the script of the name
+func (dispatch *Dispatcher) scriptSource(name string) string {
+	if name == string(dispatch.strategy) {
+		dispatch.scriptMu.RLock()
+		defer dispatch.scriptMu.RUnlock()
+		return dispatch.script
+	}
+	return otherScripts[name]
+}
+
+// cache the SHA of the loaded script of the name
+func (dispatch *Dispatcher) setSHA(name, script, sha string) error {
+	dispatch.scriptMu.Lock()
+	defer dispatch.scriptMu.Unlock()
+	if dispatch.closed {
+		return ClosedError
+	}
+	// the script was replaced in the meantime
+	if name != string(dispatch.strategy) || dispatch.script == script {
+		dispatch.shaScript[name] = sha
+	}
+	return nil
+}
+
+// a reload of the script into a redis client, see reloadScript
+type scriptReload struct {
+	done chan struct{}
+	err  error
+}
+
+// a script of a redis client, see reloadScript
+type scriptKey struct {
+	index int // of the client in clients()
+	name  string
+}
+
+// load the script into the redis client again after NOSCRIPT. The concurrent requests share a single
+// reload so that they do not flood the redis which is recovering (e.g. after a restart) with ScriptLoad.
+func (dispatch *Dispatcher) reloadScript(ctx context.Context, index int, client RedisClient, name string) error {
+	key := scriptKey{index: index, name: name}
+	dispatch.reloadMu.Lock()
+	if reload, ok := dispatch.reloads[key]; ok {
+		dispatch.reloadMu.Unlock()
+		select {
+		case <-reload.done:
+			return reload.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	reload := &scriptReload{done: make(chan struct{})}
+	if dispatch.reloads == nil {
+		dispatch.reloads = make(map[scriptKey]*scriptReload)
+	}
+	dispatch.reloads[key] = reload
+	dispatch.reloadMu.Unlock()
+
+	reload.err = dispatch.loadScriptOn(ctx, client, name)
+	dispatch.reloadMu.Lock()
+	delete(dispatch.reloads, key)
+	dispatch.reloadMu.Unlock()
+	close(reload.done)
+	return reload.err
+}
+
+// SetScript replaces the script of the strategy by a custom one (e.g. with its own cost logic),
+// it has to follow the contract of the built-in scripts (see Script) to work with the middlewares.
+// The script is loaded into redis and the fallbacks right away, the error of the first one which
+// fails is returned and the current script is kept then.
+func (dispatch *Dispatcher) SetScript(script string) error {
+	ctx := context.Background()
+	var sha string
+	for _, client := range dispatch.clients() {
+		loaded, err := client.ScriptLoad(ctx, script).Result()
+		if err != nil {
+			return err
+		}
+		sha = loaded
+	}
+	dispatch.scripts.set(script, sha)
+	dispatch.scriptMu.Lock()
+	defer dispatch.scriptMu.Unlock()
+	if dispatch.closed {
+		return ClosedError
+	}
+	dispatch.script = script
+	dispatch.shaScript[string(dispatch.strategy)] = sha
+	return nil
+}
+
+// the redis client followed by the fallbacks
+func (dispatch *Dispatcher) clients() []RedisClient {
+	return append([]RedisClient{dispatch.redisClient}, dispatch.fallbacks...)
+}
+
+// Close releases the state of the dispatcher, its middlewares fail with ClosedError afterwards
+// (see WithFailOpen). The redis client is not closed. The scripts stay loaded because the script
+// cache is shared by all the clients of the redis and SCRIPT FLUSH would remove their scripts too.
+func (dispatch *Dispatcher) Close() error {
+	dispatch.scriptMu.Lock()
+	defer dispatch.scriptMu.Unlock()
+	dispatch.closed = true
+	dispatch.shaScript = make(map[string]string)
+	return nil
+}
+
+func (dispatch *Dispatcher) isClosed() bool {
+	dispatch.scriptMu.RLock()
+	defer dispatch.scriptMu.RUnlock()
+	return dispatch.closed
+}
+
+// WithInitialCredit sets the fraction of the capacity (0 to 1) the new token buckets start with,
+// they start full by default so that the first requests of a new client can burst up to the capacity.
+// Starting lower onboards new clients gradually. It has no effect for the other strategies.
+func (dispatch *Dispatcher) WithInitialCredit(credit float64) *Dispatcher {
+	dispatch.initialCredit = math.Max(0, math.Min(1, credit))
+	return dispatch
+}
+
+// WithBurst raises the global limit of a fixed window to limit + burst when the client was idle, it had
+// no window for a whole period before, so that the returning clients can burst briefly. The following
+// windows allow the limit again. The burst of a route limit is RouteLimit.Burst. It has no effect
+// for the other strategies (see WithInitialCredit of the buckets) nor for WithLocalFallback.
+func (dispatch *Dispatcher) WithBurst(burst int) *Dispatcher {
+	if burst < 0 {
+		burst = 0
+	}
+	dispatch.burst = burst
+	return dispatch
+}
+
+// WithAlignedWindows makes the fixed windows end at the boundaries of the period (counted from
+// the zero time in UTC) instead of a period after the first request, e.g. a limit per hour resets at
+// the top of every hour. A window which starts in the middle of a period is shorter then.
+func (dispatch *Dispatcher) WithAlignedWindows(align bool) *Dispatcher {
+	dispatch.alignWindows = align
+	return dispatch
+}
+
+// WithJitter makes the fixed windows up to max longer so that the windows of the clients do not
+// reset all at once. The shift is derived from the key, so it is the same for every window of a client.
+func (dispatch *Dispatcher) WithJitter(max time.Duration) *Dispatcher {
+	dispatch.jitter = max
+	return dispatch
+}
+
+// WithKeyFunc sets the function used to derive the identity part of the redis keys
+// (e.g. user ID or API key). When nil, the client IP is used. The function is called for every
+// request, so the limiting middleware has to be registered after the ones it reads from (e.g. the
+// authentication). The requests of an empty key are logged and limited by the client IP, or
+// rejected with KeyError with WithRequireKey.
+func (dispatch *Dispatcher) WithKeyFunc(keyFunc func(*gin.Context) string) *Dispatcher {
+	dispatch.keyFunc = keyFunc
+	return dispatch
+}
+
+// WithFailOpen lets requests through when redis cannot be reached instead of
+// responding with 503. Limiting is fail-closed by default.
+func (dispatch *Dispatcher) WithFailOpen(failOpen bool) *Dispatcher {
+	dispatch.failOpen = failOpen
+	return dispatch
+}
+
+// WithErrorStatus sets the status and the Retry-After of the requests which could not be checked
+// because of redis when fail-closed, 503 and 1 second by default. Retry-After is not written when
+// retryAfter is zero.
+func (dispatch *Dispatcher) WithErrorStatus(status int, retryAfter time.Duration) *Dispatcher {
+	dispatch.errorStatus = status
+	dispatch.errorRetryAfter = retryAfter
+	return dispatch
+}
+
+// WithDryRun makes the middleware only report the requests exceeding the limits with the
+// X-RateLimit-DryRun-Exceeded header and a log message instead of rejecting them. Use it to size
+// new limits in production.
+func (dispatch *Dispatcher) WithDryRun(dryRun bool) *Dispatcher {
+	dispatch.dryRun = dryRun
+	return dispatch
+}
+
+// WithLogger sets the logger of the limiter errors, the standard logger is used by default.
+func (dispatch *Dispatcher) WithLogger(logger Logger) *Dispatcher {
+	dispatch.logger = logger
+	return dispatch
+}
+
+// WithOnLimitReached sets the handler which writes the response of a rejected request
+// instead of the default 429 with the reset time. The request is aborted afterwards.
+func (dispatch *Dispatcher) WithOnLimitReached(onLimitReached func(*gin.Context, LimitInfo)) *Dispatcher {
+	dispatch.onLimitReached = onLimitReached
+	return dispatch
+}
+
+// WithOnLimitFirstExceeded sets the hook called when a client is rejected by a limit for the first
+// time until its reset, e.g. for alerting, the following rejections do not call it. It is called
+// in the dry run mode too, before the response is written. Custom scripts of SetScript have to
+// report the first rejection (see Script), the hook is never called otherwise.
+func (dispatch *Dispatcher) WithOnLimitFirstExceeded(onFirstExceeded func(*gin.Context, LimitInfo)) *Dispatcher {
+	dispatch.onFirstExceeded = onFirstExceeded
+	return dispatch
+}
+
+// WithSoftLimit warns the clients which consumed at least the threshold (e.g. 0.8 for 80%) of a limit
+// with the X-RateLimit-Warning header so that they can slow down before they are rejected. onWarning
+// is called for such requests too unless it is nil, the requests are let through either way.
+func (dispatch *Dispatcher) WithSoftLimit(threshold float64, onWarning func(*gin.Context, LimitInfo)) *Dispatcher {
+	dispatch.softLimit = threshold
+	dispatch.onSoftLimit = onWarning
+	return dispatch
+}
+
+// get the limit of which the request consumed at least the soft limit, nil when disabled
+func (dispatch *Dispatcher) softLimitInfo(state LimitState) *LimitInfo {
+	if dispatch.softLimit <= 0 {
+		return nil
+	}
+	reached := func(limit, remaining int) bool {
+		return float64(limit-remaining) >= dispatch.softLimit*float64(limit)
+	}
+	if reached(state.GlobalLimit, state.GlobalRemaining) {
+		return &LimitInfo{Scope: GlobalScope, Limit: state.GlobalLimit, Reset: state.GlobalReset}
+	}
+	if state.RouteLimit > 0 && reached(state.RouteLimit, state.RouteRemaining) {
+		return &LimitInfo{Scope: RouteScope, Limit: state.RouteLimit, Reset: state.RouteReset}
+	}
+	return nil
+}
+
+// WithRetry retries the redis calls which failed with a transient error (e.g. a broken connection
+// or a redis which is loading, not a script error) up to attempts times before the fallbacks and
+// WithFailOpen. It waits backoff before the first retry, twice as long before the next one and so
+// on, each shifted by up to a quarter of it either way. Mind that the redis client may retry too (MaxRetries of
+// go-redis). There are no retries by default.
+func (dispatch *Dispatcher) WithRetry(attempts int, backoff time.Duration) *Dispatcher {
+	dispatch.retries = attempts
+	dispatch.retryBackoff = backoff
+	return dispatch
+}
+
+// WithClock sets the source of the current time, the system time when nil.
+func (dispatch *Dispatcher) WithClock(clock Clock) *Dispatcher {
+	if clock == nil {
+		clock = realClock{}
 	}
+	dispatch.clock = clock
+	return dispatch
+}
 
-	normalSHA, err := dispatcher.redisClient.ScriptLoad(context.Background(), Script).Result()
+// WithRedisTimeout bounds the redis calls of the middleware, failures are handled
+// according to WithFailOpen. There is no timeout by default.
+func (dispatch *Dispatcher) WithRedisTimeout(timeout time.Duration) *Dispatcher {
+	dispatch.timeout = timeout
+	return dispatch
+}
+
+// SetWhitelist sets the IPs and CIDR ranges (e.g. health checks, internal services) which are
+// never limited. FormatError is returned for an invalid entry.
+func (dispatch *Dispatcher) SetWhitelist(whitelist []string) error {
+	ipNets, err := parseIPNets(whitelist)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	dispatch.whitelist = ipNets
+	return nil
+}
+
+// SetBlacklist sets the IPs and CIDR ranges which are always rejected without asking redis.
+// FormatError is returned for an invalid entry.
+func (dispatch *Dispatcher) SetBlacklist(blacklist []string) error {
+	ipNets, err := parseIPNets(blacklist)
+	if err != nil {
+		return err
 	}
+	dispatch.blacklist = ipNets
+	return nil
+}
+
+// WithBlacklistStatus sets the status of the blacklisted requests, 403 by default.
+func (dispatch *Dispatcher) WithBlacklistStatus(status int) *Dispatcher {
+	dispatch.blacklistStatus = status
+	return dispatch
+}
+
+// WithSkip sets the predicate of the requests which are not limited at all (e.g. OPTIONS
+// preflights or requests with an internal token), they do not touch redis nor get the headers.
+func (dispatch *Dispatcher) WithSkip(skip func(*gin.Context) bool) *Dispatcher {
+	dispatch.skip = skip
+	return dispatch
+}
+
+// SetBypassMethods sets the http methods of the requests which are not limited at all like the ones
+// of WithSkip, OPTIONS (the CORS preflights) by default. Use SetBypassMethods(nil) to limit every
+// method. MethodError is returned for an unknown method.
+func (dispatch *Dispatcher) SetBypassMethods(methods []string) error {
+	bypass := make(map[string]bool, len(methods))
+	for _, method := range methods {
+		method = strings.ToUpper(method)
+		if !httpMethods[method] {
+			return MethodError
+		}
+		bypass[method] = true
+	}
+	dispatch.bypassMethods = bypass
+	return nil
+}
+
+// WithCostFunc sets the function which says how many requests the request counts for,
+// so that e.g. a bulk export consumes more of the limit than a health check. Every
+// request costs 1 by default, a request is rejected when less than its cost remains.
+func (dispatch *Dispatcher) WithCostFunc(costFunc func(*gin.Context) int) *Dispatcher {
+	dispatch.costFunc = costFunc
+	return dispatch
+}
+
+// WithCountResponse counts the requests after the handler, only those of which count returns true for
+// the status of the response (e.g. SuccessfulResponses), so that e.g. failed logins do not consume
+// the limit of a client. The requests are checked before the handler still, one is rejected when
+// less than its cost remains. The concurrent requests can exceed the limit then since they are
+// counted late, the headers report the quota before the request and WithOnLimitFirstExceeded is not
+// called. Every request is counted before the handler when count is nil, the default.
+func (dispatch *Dispatcher) WithCountResponse(count func(status int) bool) *Dispatcher {
+	dispatch.countResponse = count
+	return dispatch
+}
+
+// SuccessfulResponses counts the requests of WithCountResponse with a 2xx response.
+func SuccessfulResponses(status int) bool {
+	return status >= 200 && status < 300
+}
+
+// get the cost of the request
+func (dispatch *Dispatcher) cost(ctx *gin.Context) int {
+	if dispatch.costFunc == nil {
+		return 1
+	}
+	if cost := dispatch.costFunc(ctx); cost > 0 {
+		return cost
+	}
+	return 0
+}
+
+// RequestSize is a cost function of the Content-Length of the request. The requests of unknown
+// length (chunked) cost math.MaxInt32 so that they are rejected, RequestSizeUpTo measures them.
+func RequestSize(ctx *gin.Context) int {
+	if ctx.Request.ContentLength >= 0 {
+		return int(ctx.Request.ContentLength)
+	}
+	return math.MaxInt32
+}
+
+// RequestSizeUpTo is the cost function of the Content-Length of the request like RequestSize. The
+// body of unknown length (chunked) is read into memory up to max bytes to measure it and then served
+// from there. The larger bodies cost max + 1, so they are rejected by a limit of max bytes, and only
+// max + 1 bytes of them are held in memory.
+func RequestSizeUpTo(max int) func(*gin.Context) int {
+	return func(ctx *gin.Context) int {
+		return requestSize(ctx, max)
+	}
+}
+
+// the size of the request, the body of unknown length is read up to max + 1 bytes
+func requestSize(ctx *gin.Context, max int) int {
+	if ctx.Request.ContentLength >= 0 {
+		return int(ctx.Request.ContentLength)
+	}
+	original := ctx.Request.Body
+	body, err := io.ReadAll(io.LimitReader(original, int64(max)+1))
+	rest := io.Reader(original)
+	if err != nil {
+		rest = errReader{err}
+	}
+	ctx.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), rest))
+	return len(body)
+}
+
+// reader failing with the error of the original body once the read part is served
+type errReader struct{ err error }
 
-	shaScript := make(map[string]string)
-	shaScript["reset"] = resetSHA
-	shaScript["normal"] = normalSHA
-	dispatcher.shaScript = shaScript
-	return dispatcher, nil
+func (reader errReader) Read([]byte) (int, error) {
+	return 0, reader.err
 }
 
-// update the deadline
-func (dispatch *Dispatcher) UpdateDeadLine() {
-	dispatch.deadline = time.Now().Add(dispatch.period).Unix()
+// WithRejectStatus sets the status of the requests rejected by any limit, 429 by default.
+func (dispatch *Dispatcher) WithRejectStatus(status int) *Dispatcher {
+	dispatch.globalRejectStatus = status
+	dispatch.routeRejectStatus = status
+	return dispatch
+}
+
+// WithRejectResponse sets the body of the rejected requests, RejectJSON by default. It is not used
+// with WithOnLimitReached.
+func (dispatch *Dispatcher) WithRejectResponse(response RejectResponse) *Dispatcher {
+	dispatch.rejectResponse = response
+	return dispatch
+}
+
+// SetRejectFields sets the names of the fields of the JSON body of the rejected requests,
+// DefaultRejectFields by default. FormatError is returned when the Error or the RetryAfter name is
+// empty or when two fields have the same name.
+func (dispatch *Dispatcher) SetRejectFields(fields RejectFields) error {
+	if fields.Error == "" || fields.RetryAfter == "" {
+		return fmt.Errorf("%w The error and retry after fields are required.", FormatError)
+	}
+	names := map[string]bool{}
+	for _, name := range []string{fields.Error, fields.Scope, fields.RetryAfter, fields.Reset} {
+		if name != "" && names[name] {
+			return fmt.Errorf("%w Duplicate field %q.", FormatError, name)
+		}
+		names[name] = true
+	}
+	dispatch.rejectFields = fields
+	return nil
+}
+
+// WithRouteRejectStatus sets the status of the requests rejected by the route limit or a rule only.
+func (dispatch *Dispatcher) WithRouteRejectStatus(status int) *Dispatcher {
+	dispatch.routeRejectStatus = status
+	return dispatch
+}
+
+// WithUnknownClientKey sets the key shared by the clients whose IP cannot be resolved (e.g. behind
+// a misconfigured proxy), "unknown" by default. Such requests are rejected with ClientError when the
+// key is empty. A warning is logged for each of them either way.
+func (dispatch *Dispatcher) WithUnknownClientKey(key string) *Dispatcher {
+	dispatch.unknownClientKey = key
+	return dispatch
+}
+
+// WithRequireKey rejects the requests for which a key function (of the dispatcher, a route or a rule)
+// returns an empty key (e.g. because it runs before the authentication) with KeyError instead of
+// limiting them by the client IP.
+func (dispatch *Dispatcher) WithRequireKey(require bool) *Dispatcher {
+	dispatch.requireKey = require
+	return dispatch
+}
+
+// get the identity of the client for the redis keys
+func (dispatch *Dispatcher) identity(ctx *gin.Context, route RouteLimit, clientIp string) (string, error) {
+	keyFunc := route.KeyFunc
+	if keyFunc == nil {
+		keyFunc = dispatch.keyFunc
+	}
+	if keyFunc != nil && !route.byIP {
+		if key := keyFunc(ctx); key != "" {
+			return key, nil
+		}
+		dispatch.logger.Printf("limiter: empty key of %s %s, does the key function run before the authentication?", ctx.Request.Method, ctx.FullPath())
+		if dispatch.requireKey {
+			return "", KeyError
+		}
+	}
+	ip := net.ParseIP(clientIp)
+	if ip == nil {
+		dispatch.logger.Printf("limiter: cannot resolve the client IP of %q, check the proxy configuration", ctx.Request.RemoteAddr)
+		if dispatch.unknownClientKey == "" {
+			return "", ClientError
+		}
+		return dispatch.unknownClientKey, nil
+	}
+	return dispatch.maskIP(ip), nil
 }
 
 // get the limit
 func (dispathch *Dispatcher) GetLimit() int {
-	return dispathch.limit
+	limit, _ := dispathch.globalLimit()
+	return limit
 }
 
-// get the deadline with unix time.
+// UpdateDeadLine does nothing, the global windows are tracked per client in redis.
+//
+// Deprecated: the windows start with the first request of a client.
+func (dispatch *Dispatcher) UpdateDeadLine() {}
+
+// GetDeadLine returns the unix time when a global window starting now would end.
+//
+// Deprecated: the windows are per client, use Peek for the reset of a client.
 func (dispatch *Dispatcher) GetDeadLine() int64 {
-	return dispatch.deadline
+	_, period := dispatch.globalLimit()
+	return dispatch.clock.Now().Add(period).Unix()
+}
+
+// GetDeadLineWithString returns GetDeadLine in TimeFormat.
+//
+// Deprecated: the windows are per client, use Peek for the reset of a client.
+func (dispatch *Dispatcher) GetDeadLineWithString() string {
+	return time.Unix(dispatch.GetDeadLine(), 0).Format(TimeFormat)
+}
+
+// SetLimit changes the global limit at runtime, the next requests are checked against it.
+// For the bucket strategies it is the capacity which is still refilled within the same period.
+// LimitError is returned when limit <= 0.
+func (dispatch *Dispatcher) SetLimit(limit int) error {
+	if limit <= 0 {
+		return LimitError
+	}
+	dispatch.limitMu.Lock()
+	defer dispatch.limitMu.Unlock()
+	dispatch.limit = limit
+	return nil
+}
+
+// SetPeriod changes the period of the global limit at runtime, the windows which already started
+// keep their deadline. PeriodError is returned when period <= 0.
+func (dispatch *Dispatcher) SetPeriod(period time.Duration) error {
+	if period <= 0 {
+		return PeriodError
+	}
+	dispatch.limitMu.Lock()
+	defer dispatch.limitMu.Unlock()
+	dispatch.period = period
+	return nil
+}
+
+// get the global limit and its period
+func (dispatch *Dispatcher) globalLimit() (int, time.Duration) {
+	dispatch.limitMu.RLock()
+	defer dispatch.limitMu.RUnlock()
+	return dispatch.limit, dispatch.period
 }
 
 func (dispatch *Dispatcher) GetSHAScript(index string) string {
+	dispatch.scriptMu.RLock()
+	defer dispatch.scriptMu.RUnlock()
 	return dispatch.shaScript[index]
 }
 
-// get the deadline with format 2006-01-02 15:04:05
-func (dispatch *Dispatcher) GetDeadLineWithString() string {
-	return time.Unix(dispatch.deadline, 0).Format(TimeFormat)
+// the methods accepted by MiddleWareForMethods and SetBypassMethods
+var httpMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// RouteLimit allows `Limit` requests to a route within `Duration`, independently of the global
+// limit of the dispatcher. A request has to pass both the global and the route limit.
+type RouteLimit struct {
+	Duration time.Duration
+	Limit    int
+	// Bucket is the name of the limit shared by all the routes using it,
+	// the routes have their own limits per method when empty.
+	Bucket string
+
+	// GlobalMultiplier makes the requests of the route consume more of the global limit, e.g. 10
+	// for a heavy export counts every request 10 times against the global limit. 1 when zero.
+	GlobalMultiplier int
+
+	// GlobalShare caps the part of the global limit the route can consume within the global period,
+	// e.g. 0.3 so that a chatty route leaves at least 70% of the global limit to the other routes.
+	// The requests over it are rejected with the ShareScope. Unlimited when zero.
+	GlobalShare float64
+
+	// Burst raises the route limit of the first fixed window after idle, see WithBurst.
+	Burst int
+
+	// KeyFunc overrides the key function of the dispatcher for the requests of the route,
+	// both for the route and the global limit, e.g. to limit a route per tenant.
+	KeyFunc func(*gin.Context) string
+
+	tier string // name of the tier so that the tiers do not share the limits
+	byIP bool   // identify the clients by their IP, ignoring the key functions
+}
+
+// Validate checks that the limit and the duration are positive, the global share is at most 1 and the
+// burst is not negative.
+func (route RouteLimit) Validate() error {
+	if route.Limit <= 0 {
+		return LimitError
+	}
+	if route.Duration <= 0 {
+		return PeriodError
+	}
+	if route.GlobalMultiplier < 0 || route.GlobalShare < 0 || route.GlobalShare > 1 || route.Burst < 0 {
+		return LimitError
+	}
+	return nil
 }
 
+// MiddleWare limits the route to `limit` requests within `duration` on top of the global limit
+// of the dispatcher. The route limit is disabled when limit <= 0. It panics when the duration
+// of an enabled route limit is not positive, NewMiddleWare returns the error instead.
 func (dispatch *Dispatcher) MiddleWare(duration time.Duration, limit int) gin.HandlerFunc {
+	if limit <= 0 {
+		return dispatch.GlobalOnly()
+	}
+	handler, err := dispatch.NewMiddleWare(RouteLimit{Duration: duration, Limit: limit})
+	if err != nil {
+		panic(err)
+	}
+	return handler
+}
+
+// NewMiddleWare limits the route by the route limit on top of the global limit of the dispatcher.
+// LimitError or PeriodError is returned for an invalid route limit.
+func (dispatch *Dispatcher) NewMiddleWare(route RouteLimit) (gin.HandlerFunc, error) {
+	if err := route.Validate(); err != nil {
+		return nil, err
+	}
+	return func(ctx *gin.Context) {
+		dispatch.limitRequest(ctx, route, ctx.Next)
+	}, nil
+}
+
+// MiddleWareNamed is MiddleWare which shares the route limit with all the routes using the same
+// bucket, e.g. all the /api/v1 endpoints can share a single quota.
+func (dispatch *Dispatcher) MiddleWareNamed(bucket string, duration time.Duration, limit int) gin.HandlerFunc {
+	handler, err := dispatch.NewMiddleWare(RouteLimit{Duration: duration, Limit: limit, Bucket: bucket})
+	if err != nil {
+		panic(err)
+	}
+	return handler
+}
+
+// GlobalOnly enforces only the global limit of the dispatcher.
+func (dispatch *Dispatcher) GlobalOnly() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		dispatch.limitRequest(ctx, RouteLimit{}, ctx.Next)
+	}
+}
 
+// Wrap limits the handler by the global limit of the dispatcher, the handler is called only for
+// the allowed requests. It is handy for a single endpoint or to compose with other decorators.
+func (dispatch *Dispatcher) Wrap(handler gin.HandlerFunc) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		now := time.Now().Unix()
-		clientIp := ctx.ClientIP()
-		deadline := dispatch.GetDeadLine()
-		routeDeadline := time.Now().Add(duration).Unix()
-		routeKey := ctx.FullPath() + ctx.Request.Method + clientIp // for single route limit in redis.
-		staticKey := clientIp                                      // for global limit search in redis.
-
-		routeLimit := limit
-		staticLimit := dispatch.limit
-
-		keys := []string{routeKey, staticKey}
-		args := []interface{}{routeLimit, staticLimit, routeDeadline, now}
-
-		// mean global limit should be reset.
-		if now > deadline {
-			dispatch.UpdateDeadLine()
-			_, err := dispatch.redisClient.EvalSha(context.Background(), dispatch.GetSHAScript("reset"), keys, routeDeadline).Result()
-			if err != nil {
-				log.Println("err = ", err)
-				ctx.JSON(http.StatusInternalServerError, err)
-				ctx.Abort()
+		dispatch.limitRequest(ctx, RouteLimit{}, func() { handler(ctx) })
+	}
+}
+
+// WrapRoute is Wrap which limits the handler by the route limit on top of the global limit.
+// LimitError or PeriodError is returned for an invalid route limit.
+func (dispatch *Dispatcher) WrapRoute(route RouteLimit, handler gin.HandlerFunc) (gin.HandlerFunc, error) {
+	if err := route.Validate(); err != nil {
+		return nil, err
+	}
+	return func(ctx *gin.Context) {
+		dispatch.limitRequest(ctx, route, func() { handler(ctx) })
+	}, nil
+}
+
+// MiddleWareForMethods limits the route differently for each http method, e.g. 100 GETs but
+// only 10 POSTs per minute. Methods missing in limits are limited only by the global limit.
+func (dispatch *Dispatcher) MiddleWareForMethods(limits map[string]RouteLimit) (gin.HandlerFunc, error) {
+	methodLimits := make(map[string]RouteLimit, len(limits))
+	for method, limit := range limits {
+		method = strings.ToUpper(method)
+		if !httpMethods[method] {
+			return nil, MethodError
+		}
+		if err := limit.Validate(); err != nil {
+			return nil, err
+		}
+		methodLimits[method] = limit
+	}
+
+	return func(ctx *gin.Context) {
+		// the zero route limit of the missing methods is disabled
+		dispatch.limitRequest(ctx, methodLimits[ctx.Request.Method], ctx.Next)
+	}, nil
+}
+
+// MiddleWareTiers limits the route by the limit of the tier of the request (e.g. "free" and "premium"
+// users) returned by tierFunc. Each tier has its own limits. The requests of tiers missing in tiers
+// are rejected with TierError.
+func (dispatch *Dispatcher) MiddleWareTiers(tiers map[string]RouteLimit, tierFunc func(*gin.Context) string) (gin.HandlerFunc, error) {
+	tierLimits := make(map[string]RouteLimit, len(tiers))
+	for tier, limit := range tiers {
+		if err := limit.Validate(); err != nil {
+			return nil, err
+		}
+		limit.tier = tier
+		tierLimits[tier] = limit
+	}
+
+	return func(ctx *gin.Context) {
+		tier := tierFunc(ctx)
+		limit, ok := tierLimits[tier]
+		if !ok {
+			dispatch.logger.Printf("limiter: no limit of the tier %q", tier)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, TierError.Error())
+			return
+		}
+		dispatch.limitRequest(ctx, limit, ctx.Next)
+	}, nil
+}
+
+// MiddleWareAuthenticated limits the route by the anonymous limit for the anonymous requests and by
+// the authenticated limit for the others, e.g. 10 requests per minute of an IP but 1000 of a user.
+// isAuthenticated tells them apart, so the middleware has to run after the authentication. The
+// anonymous clients are identified by their IP, the authenticated ones by the KeyFunc of the
+// authenticated limit or the key function of the dispatcher (e.g. the user ID). LimitError or
+// PeriodError is returned for an invalid limit.
+func (dispatch *Dispatcher) MiddleWareAuthenticated(anonymous, authenticated RouteLimit, isAuthenticated func(*gin.Context) bool) (gin.HandlerFunc, error) {
+	if err := anonymous.Validate(); err != nil {
+		return nil, err
+	}
+	if err := authenticated.Validate(); err != nil {
+		return nil, err
+	}
+	anonymous.tier, anonymous.byIP = "anonymous", true
+	authenticated.tier = "authenticated"
+
+	return func(ctx *gin.Context) {
+		limit := anonymous
+		if isAuthenticated(ctx) {
+			limit = authenticated
+		}
+		dispatch.limitRequest(ctx, limit, ctx.Next)
+	}, nil
+}
+
+// limit the request with the route limit (disabled when zero), the rules and the global limit of the
+// dispatcher and run next when it is allowed, the request is counted after next with WithCountResponse
+func (dispatch *Dispatcher) limitRequest(ctx *gin.Context, route RouteLimit, next func(), rules ...Rule) {
+	count, allowed := dispatch.admit(ctx, route, rules)
+	if !allowed {
+		return
+	}
+	next()
+	if count != nil {
+		count()
+	}
+}
+
+// check the requests which are not limited at all, the bypassed methods, the skipped and the
+// whitelisted requests are allowed and the blacklisted ones aborted. limit is true for the others.
+func (dispatch *Dispatcher) screen(ctx *gin.Context, clientIp string) (limit bool, allowed bool) {
+	if dispatch.bypassMethods[ctx.Request.Method] || dispatch.skip != nil && dispatch.skip(ctx) {
+		return false, true
+	}
+	if containsIP(dispatch.whitelist, clientIp) {
+		return false, true
+	}
+	if containsIP(dispatch.blacklist, clientIp) {
+		ctx.AbortWithStatus(dispatch.blacklistStatus)
+		return false, false
+	}
+	return true, true
+}
+
+// limit the request like limitRequest, false when the request was aborted. With WithCountResponse the
+// request is only checked and count counts it.
+func (dispatch *Dispatcher) admit(ctx *gin.Context, route RouteLimit, rules []Rule) (count func(), allowed bool) {
+	clientIp := dispatch.clientIP(ctx)
+	if limit, allowed := dispatch.screen(ctx, clientIp); !limit {
+		return nil, allowed
+	}
+
+	identity, err := dispatch.identity(ctx, route, clientIp)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	path, matched := dispatch.routePath(ctx, route)
+	if !matched {
+		route.Limit = 0
+	}
+	name := dispatch.routeName(route, path, ctx.Request.Method)
+	ruleKeys, err := dispatch.ruleKeys(ctx, identity, rules)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	cost := dispatch.cost(ctx)
+	read := dispatch.countResponse != nil
+	state, exceeded, err := dispatch.check(ctx.Request.Context(), identity, route, name, cost, ruleKeys, read)
+	if err != nil {
+		return nil, dispatch.fail(ctx)
+	}
+	dispatch.countRequest(state, route, exceeded)
+	if exceeded != nil {
+		exceeded.ClientIP = clientIp
+	}
+	ctx.Set(ContextKey, state)
+
+	dispatch.setRateHeaders(ctx, state)
+	dispatch.setPolicyHeader(ctx, route, rules)
+	if exceeded != nil && exceeded.first && dispatch.onFirstExceeded != nil {
+		dispatch.onFirstExceeded(ctx, *exceeded)
+	}
+	if exceeded != nil {
+		if !dispatch.dryRun {
+			dispatch.reject(ctx, *exceeded)
+			return nil, false
+		}
+		dispatch.logger.Printf("limiter: dry run, %s exceeded the %s limit", identity, exceeded.Scope)
+		dispatch.setFlagHeader(ctx, DryRunHeader)
+	} else if warning := dispatch.softLimitInfo(state); warning != nil {
+		dispatch.setFlagHeader(ctx, WarningHeader)
+		if dispatch.onSoftLimit != nil {
+			dispatch.onSoftLimit(ctx, *warning)
+		}
+	}
+	if read {
+		count = func() {
+			if dispatch.countResponse(ctx.Writer.Status()) {
+				// the request context is canceled when the client disconnects, the request must be
+				// counted anyway. The errors are logged by check
+				dispatch.check(context.Background(), identity, route, name, cost, ruleKeys, false)
 			}
-			ctx.Header("X-RateLimit-Limit-global", strconv.Itoa(staticLimit))
-			ctx.Header("X-RateLimit-Remaining-global", strconv.Itoa(staticLimit-1))
-			ctx.Header("X-RateLimit-Reset-global", dispatch.GetDeadLineWithString())
-			ctx.Header("X-RateLimit-Limit-route", strconv.Itoa(limit))
-			ctx.Header("X-RateLimit-Remaining-route", strconv.Itoa(limit-1))
-			ctx.Header("X-RateLimit-Reset-route", time.Unix(routeDeadline, 0).Format(TimeFormat))
-			ctx.Next()
 		}
+	}
+	return count, true
+}
 
-		results, err := dispatch.redisClient.EvalSha(context.Background(), dispatch.GetSHAScript("normal"), keys, args).Result()
-		if err != nil {
-			log.Println("Result error area, error = ", err)
-			ctx.JSON(http.StatusInternalServerError, err)
-			ctx.Abort()
+// run the script of the strategy, the requests are limited in memory when no redis can be reached
+func (dispatch *Dispatcher) eval(ctx context.Context, args scriptArgs) (interface{}, error) {
+	results, err := dispatch.evalScript(ctx, string(dispatch.strategy), args.keys(), args.values()...)
+	if dispatch.local != nil && !errors.Is(err, ClosedError) {
+		if err != nil && ctx.Err() == nil {
+			return dispatch.local.eval(dispatch.logger, err, args), nil
 		}
+		dispatch.local.recover(dispatch.logger)
+	}
+	return results, err
+}
 
-		result := results.([]interface{})
-		routeRemaining := result[0].(int64)
-		staticRemaining := result[1].(int64)
-		routedeadline := time.Unix(result[2].(int64), 0).Format(TimeFormat)
+// run the script of the name, the fallbacks are tried in order when redis fails
+func (dispatch *Dispatcher) evalScript(ctx context.Context, name string, keys []string, args ...interface{}) (interface{}, error) {
+	if dispatch.isClosed() {
+		return nil, ClosedError
+	}
+	results, err := dispatch.evalOn(ctx, 0, dispatch.redisClient, name, keys, args)
+	for i, fallback := range dispatch.fallbacks {
+		// no point in trying the fallbacks when the request is gone
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		dispatch.logger.Printf("limiter: redis error: %v, trying fallback %d", err, i+1)
+		results, err = dispatch.evalOn(ctx, i+1, fallback, name, keys, args)
+	}
+	return results, err
+}
 
-		if staticRemaining == -1 {
-			ctx.JSON(http.StatusTooManyRequests, dispatch.GetDeadLineWithString())
-			ctx.Header("X-RateLimit-Reset-global", dispatch.GetDeadLineWithString())
-			ctx.Abort()
+// run the script on the redis client, bounded by the timeout
+func (dispatch *Dispatcher) evalOn(ctx context.Context, index int, client RedisClient, name string, keys []string, args []interface{}) (interface{}, error) {
+	if dispatch.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dispatch.timeout)
+		defer cancel()
+	}
+	results, err := dispatch.evalSha(ctx, client, name, keys, args)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		// the script cache was flushed (e.g. redis restart), load the script again and retry once
+		if err := dispatch.reloadScript(ctx, index, client, name); err != nil {
+			return nil, err
+		}
+		return dispatch.evalSha(ctx, client, name, keys, args)
+	}
+	return results, err
+}
+
+// run the loaded script, the transient errors are retried according to WithRetry
+func (dispatch *Dispatcher) evalSha(ctx context.Context, client RedisClient, name string, keys []string, args []interface{}) (interface{}, error) {
+	results, err := client.EvalSha(ctx, dispatch.GetSHAScript(name), keys, args...).Result()
+	backoff := dispatch.retryBackoff
+	for attempt := 0; attempt < dispatch.retries && isTransient(err); attempt++ {
+		wait := backoff
+		if backoff > 0 {
+			wait += time.Duration(rand.Int63n(int64(backoff)/2+1)) - backoff/4
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return results, err
+		case <-timer.C:
+		}
+		backoff *= 2
+		results, err = client.EvalSha(ctx, dispatch.GetSHAScript(name), keys, args...).Result()
+	}
+	return results, err
+}
+
+// errors of redis worth a retry: the network ones and the replies of a redis which is not ready,
+// not the errors of the scripts nor the canceled requests
+func isTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || err == redis.Nil {
+		return false
+	}
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		message := redisErr.Error()
+		for _, prefix := range []string{"LOADING ", "READONLY ", "CLUSTERDOWN ", "TRYAGAIN ", "MASTERDOWN "} {
+			if strings.HasPrefix(message, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// result of a single limit of the strategy script
+type windowResult struct {
+	remaining int64 // -1 when the limit rejected the request
+	reset     time.Time
+	first     bool // the first rejection until the reset
+}
+
+// check the shape of the script result, {remaining1, reset1, remaining2, reset2, ...} of n limits
+func parseResult(results interface{}, n int) ([]windowResult, error) {
+	values, ok := results.([]interface{})
+	if !ok || len(values) != 2*n {
+		return nil, ResultError
+	}
+	windows := make([]windowResult, n)
+	for i := range windows {
+		remaining, ok := values[2*i].(int64)
+		if !ok {
+			return nil, ResultError
+		}
+		reset, ok := values[2*i+1].(int64)
+		if !ok {
+			return nil, ResultError
+		}
+		windows[i] = windowResult{remaining: remaining, reset: time.UnixMilli(reset)}
+		if remaining == -2 {
+			windows[i] = windowResult{remaining: -1, reset: time.UnixMilli(reset), first: true}
 		}
+	}
+	return windows, nil
+}
 
-		if routeRemaining == -1 {
-			ctx.JSON(http.StatusTooManyRequests, routedeadline)
-			ctx.Header("X-RateLimit-Reset-single", routedeadline)
-			ctx.Abort()
+// let the request through or respond with the error status when the limit could not be checked. The
+// callers log the error, the response has ServerError only so that the clients do not learn e.g. the
+// address of redis.
+func (dispatch *Dispatcher) fail(ctx *gin.Context) bool {
+	if dispatch.failOpen {
+		if dispatch.bypassedHeader && !dispatch.disableHeaders {
+			ctx.Header(BypassedHeader, "backend-unavailable")
 		}
+		return true
+	}
+	if dispatch.errorRetryAfter > 0 {
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(dispatch.errorRetryAfter.Seconds()))))
+	}
+	ctx.AbortWithStatusJSON(dispatch.errorStatus, ServerError.Error())
+	return false
+}
 
-		ctx.Header("X-RateLimit-Limit-global", strconv.Itoa(staticLimit))
-		ctx.Header("X-RateLimit-Remaining-global", strconv.FormatInt(staticRemaining, 10))
-		ctx.Header("X-RateLimit-Reset-global", dispatch.GetDeadLineWithString())
-		ctx.Header("X-RateLimit-Limit-route", strconv.Itoa(routeLimit))
-		ctx.Header("X-RateLimit-Remaining-route", strconv.FormatInt(routeRemaining, 10))
-		ctx.Header("X-RateLimit-Reset-route", routedeadline)
-		ctx.Next()
+// write the response of a rejected request
+func (dispatch *Dispatcher) reject(ctx *gin.Context, info LimitInfo) {
+	retry := retryAfter(dispatch.clock.Now(), info.Reset)
+	ctx.Header("Retry-After", strconv.Itoa(retry))
+	ctx.Error(RateLimitedError).SetMeta(info)
+	if dispatch.onLimitReached != nil {
+		dispatch.onLimitReached(ctx, info)
+		ctx.Abort()
+		return
+	}
+	status := dispatch.globalRejectStatus
+	if info.Scope != GlobalScope {
+		status = dispatch.routeRejectStatus
+	}
+	switch dispatch.rejectResponse {
+	case RejectText:
+		ctx.Abort()
+		ctx.String(status, "rate limited by the %s limit, retry after %d seconds\n", info.Scope, retry)
+	case RejectEmpty:
+		ctx.AbortWithStatus(status)
+	default:
+		fields := dispatch.rejectFields
+		if fields == DefaultRejectFields {
+			ctx.AbortWithStatusJSON(status, RejectBody{
+				Error:      "rate_limited",
+				Scope:      info.Scope,
+				RetryAfter: retry,
+				Reset:      dispatch.formatReset(info.Reset),
+			})
+			return
+		}
+		body := map[string]interface{}{fields.Error: "rate_limited", fields.RetryAfter: retry}
+		if fields.Scope != "" {
+			body[fields.Scope] = info.Scope
+		}
+		if fields.Reset != "" {
+			body[fields.Reset] = dispatch.formatReset(info.Reset)
+		}
+		ctx.AbortWithStatusJSON(status, body)
+	}
+}
+
+// seconds from now until reset rounded up, at least 1 so that clients do not retry immediately
+func retryAfter(now, reset time.Time) int {
+	if seconds := secondsUntil(now, reset); seconds > 1 {
+		return seconds
+	}
+	return 1
+}
+
+// seconds from now until the time rounded up, never negative
+func secondsUntil(now, t time.Time) int {
+	seconds := int(math.Ceil(t.Sub(now).Seconds()))
+	if seconds < 0 {
+		return 0
+	}
+	return seconds
+}
+
+// deadline of a new window of the key in unix milliseconds, the fixed windows end at the next
+// boundary of the period when aligned and are shifted by the jitter
+func (dispatch *Dispatcher) deadline(now time.Time, period time.Duration, key string) int64 {
+	if dispatch.strategy != FixedWindow {
+		return now.Add(period).UnixMilli()
+	}
+	deadline := now.Add(period)
+	if dispatch.alignWindows {
+		deadline = now.Truncate(period).Add(period)
+	}
+	if dispatch.jitter > 0 {
+		hash := fnv.New64a()
+		hash.Write([]byte(key))
+		deadline = deadline.Add(time.Duration(hash.Sum64() % uint64(dispatch.jitter)))
 	}
+	return deadline.UnixMilli()
 }
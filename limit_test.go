@@ -0,0 +1,253 @@
+package limiter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// router of a route limit on /a, state is the state of the last allowed request
+func stateRouter(dispatch *Dispatcher, duration time.Duration, limit int) (router *gin.Engine, state *LimitState) {
+	state = &LimitState{}
+	router = gin.New()
+	router.GET("/a", dispatch.MiddleWare(duration, limit), func(ctx *gin.Context) {
+		*state, _ = GetLimitState(ctx)
+		ctx.String(http.StatusOK, "ok")
+	})
+	return router, state
+}
+
+func TestWindowsResetIndependently(t *testing.T) {
+	for _, strategy := range []Strategy{FixedWindow, SlidingWindow} {
+		t.Run(string(strategy)+"/route expired", func(t *testing.T) {
+			dispatch, _, advance := testDispatcher(t, strategy, time.Minute, 10)
+			router, state := stateRouter(dispatch, 10*time.Second, 2)
+			start := dispatch.clock.Now()
+
+			get(router, "/a")
+			get(router, "/a")
+			if code := get(router, "/a").Code; code != http.StatusTooManyRequests {
+				t.Fatalf("status %d, want the route limit reached", code)
+			}
+			advance(11 * time.Second)
+			if code := get(router, "/a").Code; code != http.StatusOK {
+				t.Fatalf("status %d after the route window", code)
+			}
+			if state.RouteRemaining != 1 || state.GlobalRemaining != 7 {
+				t.Errorf("remaining route %d and global %d, want 1 and 7", state.RouteRemaining, state.GlobalRemaining)
+			}
+			if want := dispatch.clock.Now().Add(10 * time.Second); !state.RouteReset.Equal(want) {
+				t.Errorf("route reset %v, want %v", state.RouteReset, want)
+			}
+			if want := start.Add(time.Minute); !state.GlobalReset.Equal(want) {
+				t.Errorf("global reset %v, want %v", state.GlobalReset, want)
+			}
+		})
+
+		t.Run(string(strategy)+"/global expired", func(t *testing.T) {
+			dispatch, _, advance := testDispatcher(t, strategy, time.Minute, 3)
+			router, state := stateRouter(dispatch, 5*time.Minute, 10)
+			start := dispatch.clock.Now()
+
+			get(router, "/a")
+			get(router, "/a")
+			get(router, "/a")
+			if code := get(router, "/a").Code; code != http.StatusTooManyRequests {
+				t.Fatalf("status %d, want the global limit reached", code)
+			}
+			advance(61 * time.Second)
+			if code := get(router, "/a").Code; code != http.StatusOK {
+				t.Fatalf("status %d after the global window", code)
+			}
+			// the rejected request was counted by neither limit
+			if state.GlobalRemaining != 2 || state.RouteRemaining != 6 {
+				t.Errorf("remaining global %d and route %d, want 2 and 6", state.GlobalRemaining, state.RouteRemaining)
+			}
+			if want := dispatch.clock.Now().Add(time.Minute); !state.GlobalReset.Equal(want) {
+				t.Errorf("global reset %v, want %v", state.GlobalReset, want)
+			}
+			if want := start.Add(5 * time.Minute); !state.RouteReset.Equal(want) {
+				t.Errorf("route reset %v, want %v", state.RouteReset, want)
+			}
+		})
+	}
+}
+
+func TestFirstRequestAfterReset(t *testing.T) {
+	for _, strategy := range strategies {
+		t.Run(string(strategy), func(t *testing.T) {
+			dispatch, _, advance := testDispatcher(t, strategy, time.Minute, 10)
+			dispatch.WithCostFunc(func(*gin.Context) int { return 3 })
+			router := gin.New()
+			router.GET("/a", dispatch.GlobalOnly(), func(ctx *gin.Context) { ctx.String(http.StatusOK, "ok") })
+			header := DefaultHeaderNames.GlobalRemaining
+
+			for _, want := range []string{"7", "4", "1"} {
+				if got := get(router, "/a").Header().Get(header); got != want {
+					t.Fatalf("remaining %q, want %q", got, want)
+				}
+			}
+			if code := get(router, "/a").Code; code != http.StatusTooManyRequests {
+				t.Fatalf("status %d, want the limit reached", code)
+			}
+			// the keys live a grace longer, so the script starts the new window itself
+			advance(time.Minute + 500*time.Millisecond)
+			response := get(router, "/a")
+			if response.Code != http.StatusOK || response.Header().Get(header) != "7" {
+				t.Errorf("status %d and remaining %q after the reset, want 200 and 7", response.Code, response.Header().Get(header))
+			}
+		})
+	}
+}
+
+func TestDistinctPeriods(t *testing.T) {
+	const grace = time.Second
+	for name, periods := range map[string]struct{ global, route time.Duration }{
+		"route shorter":  {time.Hour, time.Minute},
+		"global shorter": {time.Minute, time.Hour},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dispatch, server, advance := testDispatcher(t, FixedWindow, periods.global, 100)
+			router, state := stateRouter(dispatch, periods.route, 100)
+			routeKey, staticKey := dispatch.BuildKeyFor("1.2.3.4", "/a", http.MethodGet)
+			now := dispatch.clock.Now()
+
+			get(router, "/a")
+			if want := now.Add(periods.global); !state.GlobalReset.Equal(want) {
+				t.Errorf("global reset %v, want %v", state.GlobalReset, want)
+			}
+			if want := now.Add(periods.route); !state.RouteReset.Equal(want) {
+				t.Errorf("route reset %v, want %v", state.RouteReset, want)
+			}
+			if ttl := server.TTL(staticKey); ttl != periods.global+grace {
+				t.Errorf("TTL of the global key %v, want %v", ttl, periods.global+grace)
+			}
+			if ttl := server.TTL(routeKey); ttl != periods.route+grace {
+				t.Errorf("TTL of the route key %v, want %v", ttl, periods.route+grace)
+			}
+
+			// only the key of the shorter period expires
+			shorter, longer := routeKey, staticKey
+			if periods.global < periods.route {
+				shorter, longer = staticKey, routeKey
+			}
+			advance(2 * time.Minute)
+			if server.Exists(shorter) || !server.Exists(longer) {
+				t.Errorf("keys %v, want only %s", server.Keys(), longer)
+			}
+			get(router, "/a")
+			if periods.global < periods.route && (state.GlobalRemaining != 99 || state.RouteRemaining != 98) {
+				t.Errorf("remaining global %d and route %d, want 99 and 98", state.GlobalRemaining, state.RouteRemaining)
+			}
+			if periods.route < periods.global && (state.RouteRemaining != 99 || state.GlobalRemaining != 98) {
+				t.Errorf("remaining route %d and global %d, want 99 and 98", state.RouteRemaining, state.GlobalRemaining)
+			}
+		})
+	}
+}
+
+func TestCountResponseCanceled(t *testing.T) {
+	dispatch, _, _ := testDispatcher(t, FixedWindow, time.Minute, 2)
+	dispatch.WithCountResponse(SuccessfulResponses)
+	var cancel context.CancelFunc
+	router := gin.New()
+	router.GET("/a", dispatch.GlobalOnly(), func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, "ok")
+		// the client disconnects right after the response
+		cancel()
+	})
+
+	for i := 0; i < 5; i++ {
+		response := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/a", nil)
+		var requestCtx context.Context
+		requestCtx, cancel = context.WithCancel(context.Background())
+		request = request.WithContext(requestCtx)
+		request.RemoteAddr = "1.2.3.4:1"
+		router.ServeHTTP(response, request)
+		cancel()
+		want := http.StatusOK
+		if i >= 2 {
+			want = http.StatusTooManyRequests
+		}
+		if response.Code != want {
+			t.Errorf("request %d status %d, want %d", i, response.Code, want)
+		}
+	}
+	remaining, _, err := dispatch.Peek(context.Background(), dispatch.ClientKey("1.2.3.4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 0 {
+		t.Errorf("remaining %d, want 0", remaining)
+	}
+}
+
+func TestFailHidesRedisError(t *testing.T) {
+	dispatch, server, _ := testDispatcher(t, FixedWindow, time.Minute, 10)
+	concurrency, err := dispatch.MiddleWareConcurrency(1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.GET("/a", dispatch.GlobalOnly(), func(ctx *gin.Context) { ctx.String(http.StatusOK, "ok") })
+	router.GET("/c", concurrency, func(ctx *gin.Context) { ctx.String(http.StatusOK, "ok") })
+	server.Close()
+
+	for _, path := range []string{"/a", "/c"} {
+		response := get(router, path)
+		if response.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s status %d, want 503", path, response.Code)
+		}
+		if body, want := response.Body.String(), `"`+ServerError.Error()+`"`; body != want {
+			t.Errorf("%s body %s, want %s", path, body, want)
+		}
+	}
+}
+
+func TestLimitBandwidthChunked(t *testing.T) {
+	server := miniredis.RunT(t)
+	dispatch, err := LimitBandwidth(100, time.Hour, redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.POST("/a", dispatch.GlobalOnly(), func(ctx *gin.Context) {
+		body, _ := io.ReadAll(ctx.Request.Body)
+		ctx.String(http.StatusOK, string(body))
+	})
+	post := func(body io.Reader, length int64) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/a", body)
+		request.ContentLength = length
+		request.RemoteAddr = "1.2.3.4:1"
+		router.ServeHTTP(response, request)
+		return response
+	}
+
+	if response := post(strings.NewReader("0123456789"), 10); response.Code != http.StatusOK || response.Header().Get(DefaultHeaderNames.GlobalRemaining) != "90" {
+		t.Errorf("status %d and remaining %q, want 200 and 90", response.Code, response.Header().Get(DefaultHeaderNames.GlobalRemaining))
+	}
+	if code := post(strings.NewReader("0123456789"), -1).Code; code != http.StatusTooManyRequests {
+		t.Errorf("chunked status %d, want 429", code)
+	}
+
+	// the chunked bodies are buffered up to the bound of RequestSizeUpTo
+	dispatch.WithCostFunc(RequestSizeUpTo(20))
+	if response := post(strings.NewReader("0123456789"), -1); response.Code != http.StatusOK || response.Body.String() != "0123456789" {
+		t.Errorf("chunked status %d and body %q, want 200 and the body", response.Code, response.Body.String())
+	}
+	// a larger body costs the bound + 1 and is served whole
+	response := post(strings.NewReader(strings.Repeat("x", 30)), -1)
+	if response.Body.Len() != 30 || response.Header().Get(DefaultHeaderNames.GlobalRemaining) != "59" {
+		t.Errorf("body of %d bytes and remaining %q, want 30 and 59", response.Body.Len(), response.Header().Get(DefaultHeaderNames.GlobalRemaining))
+	}
+}
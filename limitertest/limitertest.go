@@ -0,0 +1,81 @@
+// Package limitertest checks the rate limit headers of a limited handler in tests, e.g. with a
+// dispatcher of a miniredis server:
+//
+//	server := miniredis.RunT(t)
+//	dispatcher, _ := limiter.LimitDispatcher(time.Minute, 3, redis.NewClient(&redis.Options{Addr: server.Addr()}))
+//	router := gin.New()
+//	router.GET("/", dispatcher.GlobalOnly(), handler)
+//
+//	request := limitertest.Request(http.MethodGet, "/", "1.2.3.4:1")
+//	limitertest.AssertWindow(t, router, request, limitertest.GlobalRemaining, 2, 1, 0)
+//	server.FastForward(time.Minute + 2*time.Second) // the keys expire a second after the window
+//	limitertest.AssertWindow(t, router, request, limitertest.GlobalRemaining, 2, 1, 0)
+package limitertest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	limiter "github.com/katomaso/gin-limiter"
+)
+
+// names of the remaining headers written by default
+var (
+	GlobalRemaining = limiter.DefaultHeaderNames.GlobalRemaining
+	RouteRemaining  = limiter.DefaultHeaderNames.RouteRemaining
+)
+
+// Request returns a function creating the requests of a client of the remote address (host:port).
+func Request(method, path, remoteAddr string) func() *http.Request {
+	return func() *http.Request {
+		request := httptest.NewRequest(method, path, nil)
+		request.RemoteAddr = remoteAddr
+		return request
+	}
+}
+
+// Drive sends n requests created by newRequest to the handler and returns their responses.
+func Drive(handler http.Handler, n int, newRequest func() *http.Request) []*httptest.ResponseRecorder {
+	responses := make([]*httptest.ResponseRecorder, n)
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		handler.ServeHTTP(responses[i], newRequest())
+	}
+	return responses
+}
+
+// AssertWindow sends a request for every remaining value and checks that it is allowed with the
+// value in the header, then it sends one more request and checks that it is rejected with the
+// header 0 and a Retry-After of at least a second. The rejection is told by the Retry-After header
+// and a status which is not 2xx, so that it works with any status of WithRejectStatus.
+func AssertWindow(t testing.TB, handler http.Handler, newRequest func() *http.Request, header string, remaining ...int) {
+	t.Helper()
+	responses := Drive(handler, len(remaining)+1, newRequest)
+	for i, want := range remaining {
+		response := responses[i]
+		if rejected(response) {
+			t.Fatalf("request %d: rejected with %d, want %s %d", i+1, response.Code, header, want)
+		}
+		if got := response.Header().Get(header); got != strconv.Itoa(want) {
+			t.Fatalf("request %d: %s is %q, want %d", i+1, header, got, want)
+		}
+	}
+
+	last := responses[len(remaining)]
+	if !rejected(last) {
+		t.Fatalf("request %d: status %d without Retry-After, want a rejection", len(responses), last.Code)
+	}
+	if got := last.Header().Get(header); got != "0" {
+		t.Fatalf("request %d: %s is %q, want 0", len(responses), header, got)
+	}
+	if retry, err := strconv.Atoi(last.Header().Get("Retry-After")); err != nil || retry < 1 {
+		t.Fatalf("request %d: Retry-After is %q, want at least 1", len(responses), last.Header().Get("Retry-After"))
+	}
+}
+
+// the limiter sets Retry-After only on the rejected requests
+func rejected(response *httptest.ResponseRecorder) bool {
+	return response.Header().Get("Retry-After") != "" && (response.Code < 200 || response.Code >= 300)
+}
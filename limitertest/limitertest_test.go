@@ -0,0 +1,49 @@
+package limitertest_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	limiter "github.com/katomaso/gin-limiter"
+	"github.com/katomaso/gin-limiter/limitertest"
+)
+
+func router(t *testing.T, rejectStatus int) (*gin.Engine, *miniredis.Miniredis) {
+	gin.SetMode(gin.TestMode)
+	server := miniredis.RunT(t)
+	dispatcher, err := limiter.LimitDispatcher(time.Minute, 3, redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rejectStatus != 0 {
+		dispatcher.WithRejectStatus(rejectStatus)
+	}
+	router := gin.New()
+	router.GET("/", dispatcher.MiddleWare(time.Minute, 2), func(ctx *gin.Context) { ctx.String(http.StatusOK, "ok") })
+	return router, server
+}
+
+func TestAssertWindow(t *testing.T) {
+	router, server := router(t, 0)
+	request := limitertest.Request(http.MethodGet, "/", "1.2.3.4:1")
+	limitertest.AssertWindow(t, router, request, limitertest.RouteRemaining, 1, 0)
+	server.FastForward(time.Minute + 2*time.Second)
+	limitertest.AssertWindow(t, router, request, limitertest.RouteRemaining, 1, 0)
+}
+
+func TestAssertWindowRejectStatus(t *testing.T) {
+	router, _ := router(t, http.StatusServiceUnavailable)
+	limitertest.AssertWindow(t, router, limitertest.Request(http.MethodGet, "/", "1.2.3.4:1"), limitertest.RouteRemaining, 1, 0)
+}
+
+func TestDrive(t *testing.T) {
+	router, _ := router(t, 0)
+	responses := limitertest.Drive(router, 3, limitertest.Request(http.MethodGet, "/", "1.2.3.4:1"))
+	if responses[0].Code != http.StatusOK || responses[2].Code != http.StatusTooManyRequests {
+		t.Fatalf("statuses %d, %d, %d", responses[0].Code, responses[1].Code, responses[2].Code)
+	}
+}
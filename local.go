@@ -0,0 +1,96 @@
+package limiter
+
+import "sync"
+
+// localLimiter limits the requests in memory while redis cannot be reached. It counts fixed windows
+// of every key like Script, so the limits are only approximate and per process.
+type localLimiter struct {
+	mu        sync.Mutex
+	windows   map[string]localWindow
+	active    bool
+	lastSweep int64
+}
+
+type localWindow struct {
+	count    int64
+	deadline int64
+	exceeded bool // the window rejected a request already
+}
+
+// WithLocalFallback makes the dispatcher limit the requests in memory when redis cannot be reached
+// instead of failing them (see WithFailOpen and WithErrorStatus). Every process counts its own fixed
+// windows, which prevents unlimited traffic during an outage. The windows are dropped when redis is
+// back. Entering and leaving the fallback mode is logged.
+func (dispatch *Dispatcher) WithLocalFallback(fallback bool) *Dispatcher {
+	dispatch.local = nil
+	if fallback {
+		dispatch.local = &localLimiter{windows: make(map[string]localWindow)}
+	}
+	return dispatch
+}
+
+// count the request in memory like the scripts, the result is that of the scripts
+func (local *localLimiter) eval(logger Logger, err error, args scriptArgs) interface{} {
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	if !local.active {
+		logger.Printf("limiter: redis error: %v, limiting in memory", err)
+		local.active = true
+	}
+
+	local.sweep(args.now)
+	result := make([]interface{}, 2*len(args.limits))
+	allowed := true
+	for i, limit := range args.limits {
+		window, ok := local.windows[limit.key]
+		if !ok || window.deadline <= args.now {
+			window = localWindow{deadline: limit.deadline}
+		}
+		remaining := int64(limit.limit) - window.count
+		if remaining < int64(args.costOf(i)) {
+			remaining = -1
+			if !window.exceeded && args.costOf(i) > 0 {
+				remaining, window.exceeded = -2, true
+			}
+			allowed = false
+		}
+		result[2*i] = remaining
+		result[2*i+1] = window.deadline
+		local.windows[limit.key] = window
+	}
+	if !allowed {
+		return result
+	}
+	for i, limit := range args.limits {
+		cost := int64(args.costOf(i))
+		window := local.windows[limit.key]
+		window.count += cost
+		local.windows[limit.key] = window
+		result[2*i] = result[2*i].(int64) - cost
+	}
+	return result
+}
+
+// leave the fallback mode once redis answers again
+func (local *localLimiter) recover(logger Logger) {
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	if local.active {
+		logger.Printf("limiter: redis is back, leaving the in-memory limiting")
+		local.active = false
+		local.windows = make(map[string]localWindow)
+	}
+}
+
+// drop the expired windows at most once a second
+func (local *localLimiter) sweep(now int64) {
+	if now-local.lastSweep < 1000 {
+		return
+	}
+	local.lastSweep = now
+	for key, window := range local.windows {
+		if window.deadline <= now {
+			delete(local.windows, key)
+		}
+	}
+}
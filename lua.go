@@ -1,79 +1,411 @@
 package limiter
 
-const ResetScript = `	
-	local routeKey = KEYS[1]
-	local staticKey = KEYS[2]
-	local routeDeadline = ARGV[1]
-
-	redis.call('HSET', staticKey, "Count", 1)
-	redis.call('HSET', routeKey, "Count", 1, "Deadline", routeDeadline)
-	return 0
+// scriptArgs are the KEYS and ARGV of the scripts of the strategies, see Script
+type scriptArgs struct {
+	now    int64 // unix milliseconds
+	cost   int
+	limits []scriptLimit // the global limit first
+	credit float64
+	costs  []int // costs of the first limits, cost for the others
+	totals bool  // count all the requests, see WithTotals
+}
+
+// scriptLimit is a limit of scriptArgs
+type scriptLimit struct {
+	key      string
+	limit    int
+	deadline int64 // of a new window in unix milliseconds
+	burst    int   // added to the limit of a fixed window after idle
+}
+
+// the KEYS of the script
+func (args scriptArgs) keys() []string {
+	keys := make([]string, len(args.limits))
+	for i, limit := range args.limits {
+		keys[i] = limit.key
+	}
+	return keys
+}
+
+// the ARGV of the script in the order of Script
+func (args scriptArgs) values() []interface{} {
+	values := make([]interface{}, 0, 2*len(args.limits)+3+len(args.costs))
+	values = append(values, args.now, args.cost)
+	burst := false
+	for _, limit := range args.limits {
+		values = append(values, limit.limit, limit.deadline)
+		burst = burst || limit.burst > 0
+	}
+	values = append(values, args.credit)
+	if !args.totals && !burst {
+		for _, cost := range args.costs {
+			values = append(values, cost)
+		}
+		return values
+	}
+	for i := range args.limits {
+		values = append(values, args.costOf(i))
+	}
+	if args.totals {
+		values = append(values, 1)
+	} else {
+		values = append(values, 0)
+	}
+	if burst {
+		for _, limit := range args.limits {
+			values = append(values, limit.burst)
+		}
+	}
+	return values
+}
+
+// the cost of the request for the ith limit
+func (args scriptArgs) costOf(i int) int {
+	if i < len(args.costs) {
+		return args.costs[i]
+	}
+	return args.cost
+}
+
+// the start of the scripts of the strategies, which reads now, cost and the costs of the keys of
+// ARGV (see Script)
+const luaCosts = `
+	local now = tonumber(ARGV[1])
+	local cost = tonumber(ARGV[2])
+	local grace = 1000 -- the keys expire a second after their state is of no use
+	local costs = {}
+	for i = 1, #KEYS do
+		costs[i] = tonumber(ARGV[2*#KEYS+3+i]) or cost
+	end
 `
 
-const Script = `
-	local result = {}
-	local routeKey = KEYS[1]
-	local staticKey = KEYS[2]
-
-	local routeLimit = tonumber(ARGV[1])
-	local staticLimit = tonumber(ARGV[2])
-	local routeDeadline = tonumber(ARGV[3]) -- 如果過期或者初次造訪 要更新的時間
-	local now = tonumber(ARGV[4])
-
-	local staticCount = redis.call('HGET', staticKey, "Count")
-
-	-- First time visit
-	if not staticCount then 
-		redis.call('HSET', staticKey, "Count", 1)
-		redis.call('HSET', routeKey, "Count", 1, "Deadline", routeDeadline)
-		result[1] = staticLimit - 1
-		result[2] = routeLimit - 1
-		result[3] = routeDeadline 
+// the totals of WithTotals in the scripts of the strategies, after luaCosts
+const luaTotals = `
+	-- count all the requests, the rejected ones too, until the deadline of a new window
+	if ARGV[3*#KEYS+4] == "1" then
+		for i, key in ipairs(KEYS) do
+			if costs[i] > 0 and redis.call('INCRBY', '#' .. key, costs[i]) == costs[i] then
+				redis.call('PEXPIRE', '#' .. key, tonumber(ARGV[2*i+2]) - now)
+			end
+		end
+	end
+`
+
+// the end of the scripts of the strategies for a rejected request: it is not counted and the first
+// rejection by a limit until its reset is flagged, see Script. The scripts define now, costs, result
+// and allowed before it.
+const luaFlags = `
+	-- limit reached, the request is not counted, the first rejection until the reset is flagged
+	if not allowed then
+		for i, key in ipairs(KEYS) do
+			if result[2*i-1] == -1 and costs[i] > 0 and redis.call('SET', '!' .. key, 1, 'PX', math.max(result[2*i] - now, 1), 'NX') then
+				result[2*i-1] = -2
+			end
+		end
 		return result
-	end 
+	end
+`
+
+// ResetScript does nothing, the windows are reset by the scripts of the strategies when they expire.
+//
+// Deprecated: it is not loaded anymore.
+const ResetScript = `return 0`
 
-	local routeInfo = redis.call('HGETALL', routeKey)
+// Script is the script of FixedWindow. The scripts of the strategies (and the custom ones of
+// SetScript) share the same contract. KEYS are the keys of the limits
+// (the global one first, then the route one if any) and ARGV are
+//
+//	ARGV[1]                  now in unix milliseconds
+//	ARGV[2]                  cost of the request
+//	ARGV[2*i+1], ARGV[2*i+2] limit and deadline of a new window (unix milliseconds) of KEYS[i]
+//	ARGV[2*#KEYS+3]          initial credit of new token buckets, the fraction of the limit they start with
+//	ARGV[2*#KEYS+3+i]        cost of the request for KEYS[i], ARGV[2] when missing
+//	ARGV[3*#KEYS+4]          "1" to count all the requests (for WithTotals) in the keys "#" .. KEYS[i]
+//	                         until the deadline of a new window, all the costs are given then
+//	ARGV[3*#KEYS+4+i]        burst of KEYS[i] (for WithBurst), all the costs and ARGV[3*#KEYS+4] are
+//	                         given then, 0 when missing. The other strategies ignore it.
+//
+// The request is counted by all the limits or by none of them, cost 0 only reads the limits. The result is the flat list
+// {remaining1, reset1, remaining2, reset2, ...} of the limits in the order of KEYS, where remaining
+// is -1 for the limits which rejected the request and reset is in unix milliseconds. Remaining is
+// -2 instead for the first rejection by a limit until its reset (for WithOnLimitFirstExceeded), the
+// key "!" .. KEYS[i] flags the limit until then. The reads of cost 0 are never flagged. The keys
+// expire shortly after their window ends (or their bucket is full or empty again), so that the
+// keys of the clients which are gone do not stay in redis.
+const Script = luaCosts + luaTotals + `
 
-	if #routeInfo == 0 then 
-		if tonumber(staticCount) < staticLimit then
-			result[1] = staticLimit - redis.call('HINCRBY', staticKey, "Count", 1)
-		else 
-			result[1] = -1
+	-- read the window stored at key, a new one starts if it is missing or expired. The new window
+	-- gets the burst when the client was idle, without a window for a whole period.
+	local function window(key, deadline, burst)
+		local info = redis.call('HMGET', key, "Count", "Deadline", "Burst")
+		local count = tonumber(info[1])
+		local dead = tonumber(info[2])
+		if not count or not dead then
+			return 0, deadline, burst, true
 		end
-		redis.call('HSET', routeKey, "Count", 1, "Deadline", routeDeadline)
-		result[2] = routeLimit - 1
-		result[3] = routeDeadline
-		return result
+		if dead <= now then
+			local period = deadline - now
+			if now < dead + period then
+				burst = 0
+			end
+			return 0, deadline, burst, true
+		end
+		return count, dead, tonumber(info[3]) or 0, false
 	end
 
-	local rDead = tonumber(routeInfo[4]) --  expired time	
-	local rCount = tonumber(routeInfo[2])  
-	local sCount = tonumber(staticCount)
-	
-	if rDead < now then -- 過期
-		if tonumber(staticCount) < staticLimit then 
-			result[1] = staticLimit - redis.call('HINCRBY', staticKey, "Count", 1)
-		else 
-			result[1] = -1
+	local result = {}
+	local fresh = {}
+	local bursts = {}
+	local allowed = true
+	for i, key in ipairs(KEYS) do
+		local limit = tonumber(ARGV[2*i+1])
+		local count, dead, burst, new = window(key, tonumber(ARGV[2*i+2]), tonumber(ARGV[3*#KEYS+4+i]) or 0)
+		local remaining = limit + burst - count
+		if remaining < costs[i] then
+			remaining = -1
+			allowed = false
 		end
-		redis.call('HSET', routeKey, "Count", 1, "Deadline", routeDeadline)
-		result[2] = routeLimit - 1
-		result[3] = routeDeadline
-		return result
+		fresh[i] = new
+		bursts[i] = burst
+		result[2*i-1] = remaining
+		result[2*i] = dead
+	end
+` + luaFlags + `
+	-- the windows with a burst stay a period longer to tell the idle clients apart
+	for i, key in ipairs(KEYS) do
+		local limit = tonumber(ARGV[2*i+1]) + bursts[i]
+		if costs[i] > 0 and fresh[i] then
+			local ttl = result[2*i] - now + grace
+			if (tonumber(ARGV[3*#KEYS+4+i]) or 0) > 0 then
+				ttl = ttl + result[2*i] - now
+			end
+			redis.call('HSET', key, "Count", costs[i], "Deadline", result[2*i], "Burst", bursts[i])
+			redis.call('PEXPIRE', key, ttl)
+			result[2*i-1] = limit - costs[i]
+		elseif costs[i] > 0 then
+			result[2*i-1] = limit - redis.call('HINCRBY', key, "Count", costs[i])
+		end
+	end
+	return result
+`
+
+const SlidingScript = luaCosts + luaTotals + `
+
+	-- every request is one member "sum/cost" of the sorted set stored at key scored by its time, where
+	-- sum is the total of the costs of the requests of the key up to it (zero padded, so that the
+	-- requests of the same millisecond sort in order). The count of a window is the difference of the
+	-- sums of its newest request and of the one before its oldest request.
+	local function entry(key, rank)
+		local member = redis.call('ZRANGE', key, rank, rank, 'WITHSCORES')
+		if #member == 0 then
+			return nil
+		end
+		local sum, c = string.match(member[1], '^(%d+)/(%d+)$')
+		return tonumber(sum), tonumber(c), tonumber(member[2])
+	end
+
+	-- drop the requests older than the period from the window stored at key and return the count of
+	-- the remaining ones, the sum of the newest one and the time when there is room for a request of cost
+	local function window(key, limit, deadline, cost)
+		local period = deadline - now
+		redis.call('ZREMRANGEBYSCORE', key, '-inf', now - period)
+		local n = redis.call('ZCARD', key)
+		if n == 0 then
+			return 0, 0, deadline
+		end
+		local first, firstCost, firstAt = entry(key, 0)
+		if not first then
+			-- the members of a previous version of the script, one per unit of cost
+			redis.call('DEL', key)
+			return 0, 0, deadline
+		end
+		local base = first - firstCost
+		local last = entry(key, -1)
+		local count = last - base
+		-- the oldest request of which the expiry leaves room for the cost, found by bisection
+		local needed = count + cost - limit
+		if needed <= 0 then
+			return count, last, firstAt + period
+		end
+		if needed > count then
+			return count, last, deadline
+		end
+		local low, high = 0, n - 1
+		while low < high do
+			local middle = math.floor((low + high) / 2)
+			if entry(key, middle) - base >= needed then
+				high = middle
+			else
+				low = middle + 1
+			end
+		end
+		local _, _, at = entry(key, low)
+		return count, last, at + period
+	end
+
+	local result = {}
+	local sums = {}
+	local allowed = true
+	for i, key in ipairs(KEYS) do
+		local limit = tonumber(ARGV[2*i+1])
+		local count, sum, dead = window(key, limit, tonumber(ARGV[2*i+2]), costs[i])
+		local remaining = limit - count
+		if remaining < costs[i] then
+			remaining = -1
+			allowed = false
+		end
+		sums[i] = sum
+		result[2*i-1] = remaining
+		result[2*i] = dead
 	end
+` + luaFlags + `
+	-- one member of the request whatever its cost
+	for i, key in ipairs(KEYS) do
+		if costs[i] > 0 then
+			redis.call('ZADD', key, now, string.format('%015.0f/%.0f', sums[i] + costs[i], costs[i]))
+			redis.call('PEXPIRE', key, tonumber(ARGV[2*i+2]) - now + grace)
+		end
+		result[2*i-1] = result[2*i-1] - costs[i]
+	end
+	return result
+`
+
+const TokenBucketScript = luaCosts + luaTotals + `
+	local credit = tonumber(ARGV[2*#KEYS+3]) or 1
+
+	-- refill the bucket stored at key, new buckets start with the initial credit
+	local function bucket(key, limit, deadline)
+		local info = redis.call('HMGET', key, "Tokens", "Updated")
+		local tokens = tonumber(info[1])
+		local updated = tonumber(info[2])
+		if not tokens or not updated then
+			return limit * credit
+		end
+		local refill = (now - updated) * limit / (deadline - now)
+		return math.min(limit, tokens + refill)
+	end
+
+	-- time when the bucket holds the wanted number of tokens
+	local function at(tokens, wanted, limit, deadline)
+		if tokens >= wanted then
+			return now
+		end
+		return now + math.ceil((wanted - tokens) * (deadline - now) / limit)
+	end
+
+	local result = {}
+	local buckets = {}
+	local allowed = true
+	for i, key in ipairs(KEYS) do
+		local limit = tonumber(ARGV[2*i+1])
+		local tokens = bucket(key, limit, tonumber(ARGV[2*i+2]))
+		buckets[i] = tokens
+		result[2*i-1] = math.floor(tokens)
+		if tokens < costs[i] then
+			result[2*i-1] = -1
+			allowed = false
+		end
+		-- the reset of a rejected request is the time when there are enough tokens
+		result[2*i] = at(tokens, costs[i], limit, tonumber(ARGV[2*i+2]))
+	end
+` + luaFlags + `
+	-- the reset is the time when the bucket is full again
+	for i, key in ipairs(KEYS) do
+		local limit = tonumber(ARGV[2*i+1])
+		local tokens = buckets[i] - costs[i]
+		if costs[i] > 0 then
+			redis.call('HSET', key, "Tokens", tokens, "Updated", now)
+			redis.call('PEXPIRE', key, tonumber(ARGV[2*i+2]) - now + grace)
+		end
+		result[2*i-1] = math.floor(tokens)
+		result[2*i] = at(tokens, limit, limit, tonumber(ARGV[2*i+2]))
+	end
+	return result
+`
 
-	if sCount < staticLimit then 
-		result[1] = staticLimit - redis.call('HINCRBY', staticKey, "Count", 1)
-	else 
-		result[1] = -1
+const LeakyBucketScript = luaCosts + luaTotals + `
+
+	-- leak the bucket stored at key, new buckets are empty
+	local function level(key, limit, deadline)
+		local info = redis.call('HMGET', key, "Level", "Leaked")
+		local filled = tonumber(info[1])
+		local leaked = tonumber(info[2])
+		if not filled or not leaked then
+			return 0
+		end
+		local leak = (now - leaked) * limit / (deadline - now)
+		return math.max(0, filled - leak)
 	end
 
-	if rCount < routeLimit then 
-		result[2] = redis.call('HINCRBY', routeKey, "Count", 1)
-	else 
-		result[2] = -1
+	-- time when the bucket leaks to the wanted level
+	local function at(filled, wanted, limit, deadline)
+		if filled <= wanted then
+			return now
+		end
+		return now + math.ceil((filled - wanted) * (deadline - now) / limit)
 	end
 
-	result[3] = rDead
+	local result = {}
+	local levels = {}
+	local allowed = true
+	for i, key in ipairs(KEYS) do
+		local limit = tonumber(ARGV[2*i+1])
+		local filled = level(key, limit, tonumber(ARGV[2*i+2]))
+		levels[i] = filled
+		result[2*i-1] = math.floor(limit - filled)
+		if filled + costs[i] > limit then
+			result[2*i-1] = -1
+			allowed = false
+		end
+		-- the reset of a rejected request is the time when there is room for it
+		result[2*i] = at(filled, limit - costs[i], limit, tonumber(ARGV[2*i+2]))
+	end
+` + luaFlags + `
+	-- the reset is the time when the bucket is empty again
+	for i, key in ipairs(KEYS) do
+		local limit = tonumber(ARGV[2*i+1])
+		local filled = levels[i] + costs[i]
+		if costs[i] > 0 then
+			redis.call('HSET', key, "Level", filled, "Leaked", now)
+			redis.call('PEXPIRE', key, tonumber(ARGV[2*i+2]) - now + grace)
+		end
+		result[2*i-1] = math.floor(limit - filled)
+		result[2*i] = at(filled, 0, limit, tonumber(ARGV[2*i+2]))
+	end
+	return result
+`
+
+// ConcurrencyScript counts the requests in flight of MiddleWareConcurrency in the sorted set KEYS[1]
+// of their ids scored by their start. ARGV are now in unix milliseconds, the time to live of a request
+// in milliseconds (after which it is dropped, e.g. when its process died), the maximum of requests in
+// flight, the id of the request and "acquire" or "release". Acquire returns the number of the requests
+// which can still start or -1 when the request is rejected.
+const ConcurrencyScript = `
+	local now = tonumber(ARGV[1])
+	local ttl = tonumber(ARGV[2])
+	local max = tonumber(ARGV[3])
+	local id = ARGV[4]
+
+	if ARGV[5] == "release" then
+		redis.call('ZREM', KEYS[1], id)
+		return 0
+	end
+
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - ttl)
+	local count = redis.call('ZCARD', KEYS[1])
+	if count >= max then
+		return -1
+	end
+	redis.call('ZADD', KEYS[1], now, id)
+	redis.call('PEXPIRE', KEYS[1], ttl)
+	return max - count - 1
+`
+
+// TotalsScript reads the totals of WithTotals of KEYS, 0 for the missing ones.
+const TotalsScript = `
+	local result = {}
+	for i, key in ipairs(KEYS) do
+		result[i] = tonumber(redis.call('GET', '#' .. key)) or 0
+	end
 	return result
 `
@@ -0,0 +1,225 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+var strategies = []Strategy{FixedWindow, SlidingWindow, TokenBucket, LeakyBucket}
+
+// testClock is a Clock moved by the tests
+type testClock struct{ now time.Time }
+
+func (clock *testClock) Now() time.Time { return clock.now }
+
+// dispatcher of the strategy on a new miniredis server with a clock of the tests, advance moves both
+func testDispatcher(t *testing.T, strategy Strategy, period time.Duration, limit int) (dispatch *Dispatcher, server *miniredis.Miniredis, advance func(time.Duration)) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	server = miniredis.RunT(t)
+	clock := &testClock{time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	dispatch, err := New(Config{
+		Redis:    redis.NewClient(&redis.Options{Addr: server.Addr()}),
+		Strategy: strategy,
+		Period:   period,
+		Limit:    limit,
+		Clock:    clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dispatch, server, func(duration time.Duration) {
+		clock.now = clock.now.Add(duration)
+		server.FastForward(duration)
+	}
+}
+
+// send a GET request of the client 1.2.3.4 to the router
+func get(router http.Handler, path string) *httptest.ResponseRecorder {
+	response := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	request.RemoteAddr = "1.2.3.4:1"
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func TestScriptsExpireKeys(t *testing.T) {
+	const grace = time.Second
+	for _, strategy := range strategies {
+		t.Run(string(strategy), func(t *testing.T) {
+			dispatch, server, _ := testDispatcher(t, strategy, time.Hour, 10)
+			dispatch.WithTotals(true)
+			router := gin.New()
+			router.GET("/a", dispatch.MiddleWare(time.Minute, 1), func(ctx *gin.Context) { ctx.String(http.StatusOK, "ok") })
+			routeKey, staticKey := dispatch.BuildKeyFor("1.2.3.4", "/a", http.MethodGet)
+
+			if code := get(router, "/a").Code; code != http.StatusOK {
+				t.Fatalf("status %d", code)
+			}
+			for key, period := range map[string]time.Duration{staticKey: time.Hour, routeKey: time.Minute} {
+				if ttl := server.TTL(key); ttl <= 0 || ttl > period+grace {
+					t.Errorf("TTL of %s is %v, want up to %v", key, ttl, period+grace)
+				}
+				if ttl := server.TTL("#" + key); ttl <= 0 || ttl > period {
+					t.Errorf("TTL of #%s is %v, want up to %v", key, ttl, period)
+				}
+			}
+
+			if code := get(router, "/a").Code; code != http.StatusTooManyRequests {
+				t.Fatalf("status %d", code)
+			}
+			if ttl := server.TTL("!" + routeKey); ttl <= 0 || ttl > time.Minute {
+				t.Errorf("TTL of !%s is %v, want up to %v", routeKey, ttl, time.Minute)
+			}
+		})
+	}
+}
+
+func TestScriptArgsOrder(t *testing.T) {
+	args := scriptArgs{
+		now:    1000,
+		cost:   1,
+		limits: []scriptLimit{{"a", 10, 61000, 3}, {"b", 20, 62000, 0}},
+		credit: 0.5,
+		costs:  []int{5},
+		totals: true,
+	}
+	if keys := args.keys(); len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Fatalf("keys %v", keys)
+	}
+	// ARGV of Script, ARGV[i] is want[i-1]
+	want := []interface{}{
+		int64(1000), 1, // now and the cost
+		10, int64(61000), 20, int64(62000), // the limits and the deadlines
+		0.5,  // the credit
+		5, 1, // the costs
+		1,    // the totals
+		3, 0, // the bursts
+	}
+	values := args.values()
+	if len(values) != len(want) {
+		t.Fatalf("%d values %v, want %d", len(values), values, len(want))
+	}
+	for i, value := range want {
+		if values[i] != value {
+			t.Errorf("ARGV[%d] is %#v, want %#v", i+1, values[i], value)
+		}
+	}
+
+	// the tails are left out when they are not needed
+	args.limits[0].burst, args.totals = 0, false
+	if values := args.values(); len(values) != 8 {
+		t.Errorf("values %v without totals and bursts, want only the first cost", values)
+	}
+	args.costs = nil
+	if values := args.values(); len(values) != 7 {
+		t.Errorf("values %v without costs, want none", values)
+	}
+}
+
+func TestScriptsReadArgs(t *testing.T) {
+	for _, strategy := range strategies {
+		t.Run(string(strategy), func(t *testing.T) {
+			dispatch, server, _ := testDispatcher(t, strategy, time.Minute, 10)
+			now := dispatch.clock.Now()
+			deadline := now.Add(time.Minute).UnixMilli()
+			eval := func(args scriptArgs) []windowResult {
+				t.Helper()
+				results, err := dispatch.eval(context.Background(), args)
+				if err != nil {
+					t.Fatal(err)
+				}
+				windows, err := parseResult(results, len(args.limits))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return windows
+			}
+
+			// the cost of the first key and ARGV[2] for the second one
+			windows := eval(scriptArgs{now: now.UnixMilli(), cost: 1, credit: 1, costs: []int{5},
+				limits: []scriptLimit{{"cost:a", 10, deadline, 0}, {"cost:b", 10, deadline, 0}}})
+			if windows[0].remaining != 5 || windows[1].remaining != 9 {
+				t.Errorf("remaining %d and %d, want 5 and 9", windows[0].remaining, windows[1].remaining)
+			}
+
+			// the totals of all the keys with their costs
+			eval(scriptArgs{now: now.UnixMilli(), cost: 1, credit: 1, costs: []int{5}, totals: true,
+				limits: []scriptLimit{{"totals:a", 10, deadline, 0}, {"totals:b", 10, deadline, 0}}})
+			if a, _ := server.Get("#totals:a"); a != "5" {
+				t.Errorf("total of a is %q, want 5", a)
+			}
+			if b, _ := server.Get("#totals:b"); b != "1" {
+				t.Errorf("total of b is %q, want 1", b)
+			}
+
+			// the burst of the first key, without totals, only the fixed windows burst
+			windows = eval(scriptArgs{now: now.UnixMilli(), cost: 1, credit: 1,
+				limits: []scriptLimit{{"burst:a", 10, deadline, 3}, {"burst:b", 10, deadline, 0}}})
+			wantBurst := int64(9)
+			if strategy == FixedWindow {
+				wantBurst = 12
+			}
+			if windows[0].remaining != wantBurst || windows[1].remaining != 9 {
+				t.Errorf("remaining %d and %d, want %d and 9", windows[0].remaining, windows[1].remaining, wantBurst)
+			}
+			if server.Exists("#burst:a") || server.Exists("#burst:b") {
+				t.Error("totals counted without ARGV[3*#KEYS+4]")
+			}
+		})
+	}
+}
+
+func TestSlidingScriptCosts(t *testing.T) {
+	dispatch, server, _ := testDispatcher(t, SlidingWindow, time.Minute, 10)
+	start := dispatch.clock.Now().UnixMilli()
+	period := time.Minute.Milliseconds()
+	eval := func(at int64, cost int) windowResult {
+		t.Helper()
+		results, err := dispatch.eval(context.Background(), scriptArgs{now: start + at, cost: cost, credit: 1,
+			limits: []scriptLimit{{"a", 10, start + at + period, 0}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		windows, err := parseResult(results, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return windows[0]
+	}
+
+	for _, request := range []struct {
+		at              int64
+		cost, remaining int
+	}{{0, 4, 6}, {10000, 3, 3}, {20000, 3, 0}} {
+		if window := eval(request.at, request.cost); window.remaining != int64(request.remaining) || !window.reset.Equal(time.UnixMilli(start+period)) {
+			t.Errorf("remaining %d and reset %v at %d, want %d and the end of the first request", window.remaining, window.reset, request.at, request.remaining)
+		}
+	}
+	// one member of every request
+	if members, _ := server.ZMembers("a"); len(members) != 3 {
+		t.Errorf("members %v, want 3", members)
+	}
+	// the first two requests have to expire for a cost of 5
+	if window := eval(30000, 5); window.remaining >= 0 || !window.reset.Equal(time.UnixMilli(start+10000+period)) {
+		t.Errorf("remaining %d and reset %v, want a rejection until the second request expires", window.remaining, window.reset)
+	}
+	if window := eval(period+1, 4); window.remaining != 0 {
+		t.Errorf("remaining %d after the first request expired, want 0", window.remaining)
+	}
+
+	// the members of one unit of cost of the previous script start a new window
+	server.Del("a")
+	server.ZAdd("a", float64(start+period), fmt.Sprintf("%d:0", start+period))
+	if window := eval(period+2, 1); window.remaining != 9 {
+		t.Errorf("remaining %d of a window of the previous script, want 9", window.remaining)
+	}
+}
@@ -0,0 +1,37 @@
+package limiter
+
+// Metrics counts the decisions of the limiter by scope (GlobalScope, RouteScope, ShareScope,
+// ConcurrencyScope or the name of a rule). An allowed request is counted once for each limit it
+// passed, a rejected one for the limit which rejected it. Requests exceeding a limit in the dry run
+// mode are counted as rejected.
+type Metrics interface {
+	IncAllowed(scope string)
+	IncRejected(scope string)
+}
+
+// WithMetrics sets the metrics of the limiter, e.g. an adapter of prometheus counters.
+func (dispatch *Dispatcher) WithMetrics(metrics Metrics) *Dispatcher {
+	dispatch.metrics = metrics
+	return dispatch
+}
+
+// count the decision about the request of the route limit
+func (dispatch *Dispatcher) countRequest(state LimitState, route RouteLimit, exceeded *LimitInfo) {
+	if dispatch.metrics == nil {
+		return
+	}
+	if exceeded != nil {
+		dispatch.metrics.IncRejected(exceeded.Scope)
+		return
+	}
+	dispatch.metrics.IncAllowed(GlobalScope)
+	if state.RouteLimit > 0 {
+		dispatch.metrics.IncAllowed(RouteScope)
+	}
+	for _, rule := range state.Rules {
+		dispatch.metrics.IncAllowed(rule.Name)
+	}
+	if route.GlobalShare > 0 {
+		dispatch.metrics.IncAllowed(ShareScope)
+	}
+}
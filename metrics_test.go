@@ -0,0 +1,43 @@
+package limiter
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testMetrics records the scopes of the decisions
+type testMetrics struct{ allowed, rejected []string }
+
+func (metrics *testMetrics) IncAllowed(scope string)  { metrics.allowed = append(metrics.allowed, scope) }
+func (metrics *testMetrics) IncRejected(scope string) { metrics.rejected = append(metrics.rejected, scope) }
+
+func TestMetricsScopes(t *testing.T) {
+	dispatch, _, _ := testDispatcher(t, FixedWindow, time.Minute, 10)
+	metrics := &testMetrics{}
+	dispatch.WithMetrics(metrics)
+	rules, err := dispatch.MiddleWareRules(Rule{Name: "burst", Limit: 1, Period: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	methods, err := dispatch.MiddleWareForMethods(map[string]RouteLimit{http.MethodGet: {Duration: time.Minute, Limit: 5, GlobalShare: 0.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.GET("/rules", rules, func(ctx *gin.Context) { ctx.String(http.StatusOK, "ok") })
+	router.GET("/share", methods, func(ctx *gin.Context) { ctx.String(http.StatusOK, "ok") })
+
+	get(router, "/rules")
+	get(router, "/rules")
+	get(router, "/share")
+	if want := []string{GlobalScope, "burst", GlobalScope, RouteScope, ShareScope}; !reflect.DeepEqual(metrics.allowed, want) {
+		t.Errorf("allowed %v, want %v", metrics.allowed, want)
+	}
+	if want := []string{"burst"}; !reflect.DeepEqual(metrics.rejected, want) {
+		t.Errorf("rejected %v, want %v", metrics.rejected, want)
+	}
+}
@@ -0,0 +1,58 @@
+// Package promlimiter counts the decisions of a limiter.Dispatcher (see limiter.Metrics) with
+// prometheus counters. It is a module of its own, so that the users of the limiter do not depend on
+// prometheus.
+package promlimiter
+
+import (
+	limiter "github.com/katomaso/gin-limiter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ScopeLabel is the label of the scope of the counters, e.g. limiter.GlobalScope or the name of a rule.
+const ScopeLabel = "scope"
+
+// Metrics counts the allowed and the rejected requests of the limiter by their scope.
+type Metrics struct {
+	Allowed  *prometheus.CounterVec
+	Rejected *prometheus.CounterVec
+}
+
+var _ limiter.Metrics = (*Metrics)(nil)
+
+// NewMetrics creates the counters <namespace>_ratelimit_allowed_total and
+// <namespace>_ratelimit_rejected_total and registers them with the registerer, e.g.
+// prometheus.DefaultRegisterer. The error of the registration is returned.
+func NewMetrics(namespace string, registerer prometheus.Registerer) (*Metrics, error) {
+	metrics := &Metrics{
+		Allowed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "ratelimit",
+			Name:      "allowed_total",
+			Help:      "Requests allowed by the rate limiter by the scope of the limit they passed.",
+		}, []string{ScopeLabel}),
+		Rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "ratelimit",
+			Name:      "rejected_total",
+			Help:      "Requests rejected by the rate limiter by the scope of the limit which rejected them.",
+		}, []string{ScopeLabel}),
+	}
+	if err := registerer.Register(metrics.Allowed); err != nil {
+		return nil, err
+	}
+	if err := registerer.Register(metrics.Rejected); err != nil {
+		registerer.Unregister(metrics.Allowed)
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// IncAllowed counts a request allowed by the limit of the scope.
+func (metrics *Metrics) IncAllowed(scope string) {
+	metrics.Allowed.WithLabelValues(scope).Inc()
+}
+
+// IncRejected counts a request rejected by the limit of the scope.
+func (metrics *Metrics) IncRejected(scope string) {
+	metrics.Rejected.WithLabelValues(scope).Inc()
+}
@@ -0,0 +1,47 @@
+package promlimiter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	limiter "github.com/katomaso/gin-limiter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := miniredis.RunT(t)
+	dispatch, err := limiter.LimitDispatcher(time.Minute, 1, redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	metrics, err := NewMetrics("app", registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch.WithMetrics(metrics)
+	router := gin.New()
+	router.GET("/a", dispatch.GlobalOnly(), func(ctx *gin.Context) { ctx.String(http.StatusOK, "ok") })
+	for i := 0; i < 3; i++ {
+		request := httptest.NewRequest(http.MethodGet, "/a", nil)
+		request.RemoteAddr = "1.2.3.4:1"
+		router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	if allowed := testutil.ToFloat64(metrics.Allowed.WithLabelValues(limiter.GlobalScope)); allowed != 1 {
+		t.Errorf("allowed %v, want 1", allowed)
+	}
+	if rejected := testutil.ToFloat64(metrics.Rejected.WithLabelValues(limiter.GlobalScope)); rejected != 2 {
+		t.Errorf("rejected %v, want 2", rejected)
+	}
+	if _, err := NewMetrics("app", registry); err == nil {
+		t.Error("the counters were registered twice")
+	}
+}
@@ -0,0 +1,52 @@
+package limiter
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RouteRule is the route limit of a route of Apply.
+type RouteRule struct {
+	Method string // all the methods of the path when empty
+	Path   string // full path of the route, as registered in gin (e.g. /users/:id)
+	Limit  int
+	Period time.Duration
+}
+
+// Apply limits all the routes of the router by the global limit and the routes of the rules by their
+// route limits too, so that the whole policy is defined in one place. Like any gin middleware it
+// applies only to the routes registered after it. MethodError, FormatError (a path not starting with
+// "/" or a duplicate rule), LimitError or PeriodError is returned for invalid rules.
+func (dispatch *Dispatcher) Apply(router gin.IRoutes, rules []RouteRule) error {
+	limits := make(map[string]RouteLimit, len(rules))
+	for _, rule := range rules {
+		method := strings.ToUpper(rule.Method)
+		if method != "" && !httpMethods[method] {
+			return MethodError
+		}
+		if !strings.HasPrefix(rule.Path, "/") {
+			return fmt.Errorf("%w Invalid path %q.", FormatError, rule.Path)
+		}
+		key := method + " " + rule.Path
+		if _, ok := limits[key]; ok {
+			return fmt.Errorf("%w Duplicate rule of %s %s.", FormatError, rule.Method, rule.Path)
+		}
+		limit := RouteLimit{Duration: rule.Period, Limit: rule.Limit}
+		if err := limit.Validate(); err != nil {
+			return err
+		}
+		limits[key] = limit
+	}
+
+	router.Use(func(ctx *gin.Context) {
+		limit, ok := limits[ctx.Request.Method+" "+ctx.FullPath()]
+		if !ok {
+			limit = limits[" "+ctx.FullPath()]
+		}
+		dispatch.limitRequest(ctx, limit, ctx.Next)
+	})
+	return nil
+}
@@ -0,0 +1,80 @@
+package limiter
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rule is a limit of its own dimension, e.g. per user or per API key, on top of the global limit.
+// The routes using rules of the same name share their limit.
+type Rule struct {
+	Name    string                    // reported as the scope of the rejected requests
+	KeyFunc func(*gin.Context) string // identity of the client by the dispatcher when nil or empty
+	Limit   int
+	Period  time.Duration
+}
+
+// RuleState is the state of a rule after the request was counted.
+type RuleState struct {
+	Name      string
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// a rule with the key of the request
+type ruleKey struct {
+	Rule
+	key string
+}
+
+// MiddleWareRules limits the route by all the rules at once on top of the global limit, e.g. 1000
+// requests per hour of a user and 100 requests per minute of an IP. The request is counted by all
+// of them or rejected by the first one reached. LimitError, PeriodError or FormatError (a rule
+// without a name or with a duplicate one) is returned for invalid rules.
+//
+// The keys of the rules are built from different identities so they do not share a hash slot,
+// the rules cannot be used on a Redis Cluster.
+func (dispatch *Dispatcher) MiddleWareRules(rules ...Rule) (gin.HandlerFunc, error) {
+	names := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if rule.Name == "" || rule.Name == GlobalScope || rule.Name == RouteScope || rule.Name == ShareScope || names[rule.Name] {
+			return nil, fmt.Errorf("%w Invalid rule name %q.", FormatError, rule.Name)
+		}
+		names[rule.Name] = true
+		if rule.Limit <= 0 {
+			return nil, LimitError
+		}
+		if rule.Period <= 0 {
+			return nil, PeriodError
+		}
+	}
+	return func(ctx *gin.Context) {
+		dispatch.limitRequest(ctx, RouteLimit{}, ctx.Next, rules...)
+	}, nil
+}
+
+// build the keys of the rules for the request of the identity, an empty key of a rule is the identity
+// or KeyError with WithRequireKey
+func (dispatch *Dispatcher) ruleKeys(ctx *gin.Context, identity string, rules []Rule) ([]ruleKey, error) {
+	keys := make([]ruleKey, len(rules))
+	for i, rule := range rules {
+		ruleIdentity := identity
+		if rule.KeyFunc != nil {
+			if key := rule.KeyFunc(ctx); key != "" {
+				ruleIdentity = key
+			} else {
+				dispatch.logger.Printf("limiter: empty key of the rule %q of %s %s, does the key function run before the authentication?", rule.Name, ctx.Request.Method, ctx.FullPath())
+				if dispatch.requireKey {
+					return nil, KeyError
+				}
+			}
+		}
+		delimiter := dispatch.keyDelimiter
+		key, _ := dispatch.buildKeys(delimiter+"n"+delimiter+escapeKey(rule.Name, delimiter), ruleIdentity)
+		keys[i] = ruleKey{Rule: rule, key: key}
+	}
+	return keys, nil
+}
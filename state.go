@@ -0,0 +1,73 @@
+package limiter
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ContextKey is the key of the LimitState of the request in the gin context.
+const ContextKey = "ratelimit"
+
+// LimitState is the state of the limits of the client after its request was counted.
+type LimitState struct {
+	GlobalLimit     int
+	GlobalRemaining int
+	GlobalReset     time.Time
+	RouteLimit      int
+	RouteRemaining  int
+	RouteReset      time.Time
+	Rules           []RuleState // of MiddleWareRules
+
+	clock Clock // of the dispatcher, the system time when nil
+}
+
+// GetLimitState returns the LimitState stored by the middleware for downstream handlers.
+func GetLimitState(ctx *gin.Context) (LimitState, bool) {
+	value, ok := ctx.Get(ContextKey)
+	if !ok {
+		return LimitState{}, false
+	}
+	state, ok := value.(LimitState)
+	return state, ok
+}
+
+// TimeUntilReset is the time until the reset of the limit closer to be reached (global or route),
+// never negative. Use it for the backoff of the clients or for custom responses.
+func (state LimitState) TimeUntilReset() time.Duration {
+	_, _, reset := state.closest()
+	if until := reset.Sub(state.now()); until > 0 {
+		return until
+	}
+	return 0
+}
+
+// SecondsUntilReset is TimeUntilReset rounded up to seconds, as in Retry-After.
+func (state LimitState) SecondsUntilReset() int {
+	_, _, reset := state.closest()
+	return secondsUntil(state.now(), reset)
+}
+
+// the current time of the clock of the dispatcher
+func (state LimitState) now() time.Time {
+	if state.clock == nil {
+		return time.Now()
+	}
+	return state.clock.Now()
+}
+
+// the limit, remaining and reset of the limit with the lower remaining, the global one on a tie
+func (state LimitState) closest() (int, int, time.Time) {
+	if state.RouteLimit > 0 && state.RouteRemaining < state.GlobalRemaining {
+		return state.RouteLimit, state.RouteRemaining, state.RouteReset
+	}
+	return state.GlobalLimit, state.GlobalRemaining, state.GlobalReset
+}
+
+// remaining count, the script returns -1 when the limit is reached
+func remaining(value int64) int {
+	if value < 0 {
+		return 0
+	}
+	return int(value)
+}
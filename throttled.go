@@ -0,0 +1,64 @@
+package limiter
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// the clients which can list the keys, all the go-redis clients can
+type scanner interface {
+	Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd
+}
+
+// ThrottledKeys returns the redis keys of the limits which rejected a request and did not reset
+// since, e.g. for an admin view of the blocked clients. It scans the flags of the first rejection
+// (see Script) with SCAN on every redis (every master of a cluster) so that redis is not blocked,
+// the keys are read at different times and the list is only approximate. ScanError is returned for
+// the clients without Scan. The clients which fail are skipped, the keys of the others are returned
+// with the first error then.
+func (dispatch *Dispatcher) ThrottledKeys(ctx context.Context) ([]string, error) {
+	match := "!" + escapeGlob(dispatch.keyPrefix) + "*"
+	seen := make(map[string]bool)
+	var keys []string
+	var keysMu sync.Mutex // the masters of a cluster are scanned concurrently
+	collect := func(ctx context.Context, client scanner) error {
+		iter := client.Scan(ctx, 0, match, 100).Iterator()
+		for iter.Next(ctx) {
+			key := strings.TrimPrefix(iter.Val(), "!")
+			keysMu.Lock()
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+			keysMu.Unlock()
+		}
+		return iter.Err()
+	}
+
+	var err error
+	for _, client := range dispatch.clients() {
+		var scanErr error
+		switch client := client.(type) {
+		case *redis.ClusterClient:
+			scanErr = client.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+				return collect(ctx, master)
+			})
+		case scanner:
+			scanErr = collect(ctx, client)
+		default:
+			scanErr = ScanError
+		}
+		if scanErr != nil && err == nil {
+			err = scanErr
+		}
+	}
+	return keys, err
+}
+
+// escape the special characters of the glob patterns of redis
+func escapeGlob(pattern string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(pattern)
+}
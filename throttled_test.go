@@ -0,0 +1,39 @@
+package limiter
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestThrottledKeysUnreachableFallback(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	primary, fallback := miniredis.RunT(t), miniredis.RunT(t)
+	dispatch, err := New(Config{
+		Redis:     redis.NewClient(&redis.Options{Addr: primary.Addr()}),
+		Fallbacks: []RedisClient{redis.NewClient(&redis.Options{Addr: fallback.Addr()})},
+		Period:    time.Minute,
+		Limit:     1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.GET("/a", dispatch.GlobalOnly(), func(ctx *gin.Context) { ctx.String(http.StatusOK, "ok") })
+	get(router, "/a")
+	get(router, "/a")
+	fallback.Close()
+
+	keys, err := dispatch.ThrottledKeys(context.Background())
+	if err == nil {
+		t.Error("no error of the unreachable fallback")
+	}
+	if _, staticKey := dispatch.BuildKeyFor("1.2.3.4", "/a", http.MethodGet); len(keys) != 1 || keys[0] != staticKey {
+		t.Errorf("keys %v, want %s of the primary", keys, staticKey)
+	}
+}
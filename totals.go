@@ -0,0 +1,46 @@
+package limiter
+
+import "context"
+
+// name of TotalsScript in the SHA cache
+const totalsScript = "totals"
+
+// WithTotals counts all the requests of the limits, the rejected ones too, until the end of their
+// windows (for the bucket strategies the period after the first request), to see how far over the
+// limits the clients go. Totals reads them. The requests limited in memory of WithLocalFallback are
+// not counted.
+func (dispatch *Dispatcher) WithTotals(totals bool) *Dispatcher {
+	dispatch.totals = totals
+	return dispatch
+}
+
+// Totals returns the requests of WithTotals of the client identified by key counted by its global
+// limit and by its limits of the routes, in this order.
+func (dispatch *Dispatcher) Totals(ctx context.Context, key string, routes ...Route) ([]int64, error) {
+	_, staticKey := dispatch.buildKeys("", key)
+	keys := []string{staticKey}
+	for _, route := range routes {
+		routeKey, _ := dispatch.buildKeys(dispatch.routeNameOf(route), key)
+		keys = append(keys, routeKey)
+	}
+	if dispatch.GetSHAScript(totalsScript) == "" {
+		if err := dispatch.loadScript(ctx, totalsScript); err != nil {
+			return nil, err
+		}
+	}
+	results, err := dispatch.evalScript(ctx, totalsScript, keys)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := results.([]interface{})
+	if !ok || len(values) != len(keys) {
+		return nil, ResultError
+	}
+	totals := make([]int64, len(values))
+	for i, value := range values {
+		if totals[i], ok = value.(int64); !ok {
+			return nil, ResultError
+		}
+	}
+	return totals, nil
+}
@@ -0,0 +1,27 @@
+package limiter
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTotalsMethodCase(t *testing.T) {
+	dispatch, _, _ := testDispatcher(t, FixedWindow, time.Minute, 10)
+	dispatch.WithTotals(true)
+	router := gin.New()
+	router.GET("/a", dispatch.MiddleWare(time.Minute, 1), func(ctx *gin.Context) { ctx.String(http.StatusOK, "ok") })
+	get(router, "/a")
+	get(router, "/a")
+
+	totals, err := dispatch.Totals(context.Background(), dispatch.ClientKey("1.2.3.4"), Route{Path: "/a", Method: "get"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(totals) != 2 || totals[0] != 2 || totals[1] != 2 {
+		t.Errorf("totals %v, want 2 of the global and 2 of the route limit", totals)
+	}
+}